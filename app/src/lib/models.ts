@@ -34,6 +34,10 @@ export const zUserSchema = zModelBase.extend({
   avatar: z.string(),
   role: z.enum(['editor', 'student']),
   maxPods: z.number().int(),
+  maxSnapshots: z.number().int(),
+  // 0 is unlimited
+  weeklyHours: z.number(),
+  // no longer written, pods have an owner instead
   pods: z.string().array(),
 });
 
@@ -120,6 +124,10 @@ export const zClassSchema = zModelBase.extend({
   latitude: z.number(),
   longitude: z.number(),
   radius: z.number(),
+  podTemplate: z.string(),
+  archived: z.boolean(),
+  // per student, 0 is unlimited
+  weeklyHours: z.number(),
 });
 
 export const zClassWithPresenceSchema = zClassSchema.extend({
@@ -151,15 +159,88 @@ export const zPollAnswerWithUserSchema = zPollAnswerSchema.extend({
 export const zPodServerSchema = zModelBase.extend({
   name: z.string(),
   address: z.string(),
+  status: z.enum(['online', 'offline', '']),
+  lastSeen: z.string(),
+  // milliseconds
+  latency: z.number(),
+  lastError: z.string(),
+  mode: z.enum(['active', 'draining', 'maintenance', '']),
+  drainDeadline: z.string(),
+  drainStopPods: z.boolean(),
+});
+
+export const zPodTemplateSchema = zModelBase.extend({
+  name: z.string(),
+  description: z.string(),
+  image: z.string(),
+  env: z.record(z.string()).nullable(),
+  // only makes the security profile of the pod server stricter
+  security: z
+    .object({
+      CapDrop: z.string().array().nullish(),
+      CapAdd: z.string().array().nullish(),
+      NoNewPrivileges: z.boolean().optional(),
+      PidsLimit: z.number().optional(),
+      ReadonlyRootfs: z.boolean().optional(),
+      Tmpfs: z.record(z.string()).nullish(),
+      User: z.string().optional(),
+    })
+    .nullable(),
+  // 0 never hibernates
+  hibernateAfterDays: z.number(),
 });
 
 export const zPodSchema = zModelBase.extend({
   podId: z.string(),
   name: z.string(),
+  owner: z.string(),
   image: z.string(),
+  template: z.string(),
+  class: z.string(),
+  // only set for the pods a class provisioned for a student
+  student: z.string(),
+  state: z.enum(['provisioning', 'ready', 'failed', 'hibernating', 'hibernated', 'waking', '']),
+  provisionError: z.string(),
+  hibernatedImage: z.string(),
+  hibernationArchive: z.string(),
+  migrationStatus: z.enum(['running', 'done', 'failed', '']),
+  migrationStep: z.string(),
+  migrationError: z.string(),
   server: z.string(),
   running: z.boolean(),
   status: z.string(),
+  volume: z.string(),
+  keepVolume: z.boolean(),
+  // set over the env of the template, applied when the container is created
+  env: z.record(z.string()).nullable(),
+  health: z.string(),
+  restartCount: z.number(),
+  ipAddress: z.string(),
+  inspect: z.unknown(),
+  restartPolicy: z.enum(['never', 'on-failure', 'always', '']),
+  restartMaxRetries: z.number(),
+  crashLoop: z.boolean(),
+  exitHistory: z
+    .object({ time: z.string(), exitCode: z.number(), oomKilled: z.boolean() })
+    .array()
+    .nullable(),
+});
+
+export const zPodCollaboratorSchema = zModelBase.extend({
+  pod: z.string(),
+  user: z.string(),
+  // viewers attach read-only, operators can also start and stop the pod
+  role: z.enum(['viewer', 'operator']),
+  invitedBy: z.string(),
+});
+
+export const zPodSecretSchema = zModelBase.extend({
+  // either a pod or a template
+  pod: z.string(),
+  template: z.string(),
+  name: z.string(),
+  // write-only, always empty when read
+  value: z.string(),
 });
 
 export const zPodServerWithPodsSchema = zPodServerSchema.extend({
@@ -174,6 +255,65 @@ export const zPodWithServerSchema = zPodSchema.extend({
   expand: z.object({ server: zPodServerSchema }).optional(),
 });
 
+export const zPodScheduleSchema = zModelBase.extend({
+  pod: z.string(),
+  class: z.string(),
+  action: z.enum(['start', 'stop']),
+  cron: z.string(),
+  at: z.string(),
+  enabled: z.boolean(),
+  lastRun: z.string(),
+});
+
+export const zPodScheduleRunSchema = zModelBase.extend({
+  schedule: z.string(),
+  action: z.enum(['start', 'stop']),
+  scheduledFor: z.string(),
+  missed: z.boolean(),
+  ok: z.boolean(),
+  error: z.string(),
+  results: z
+    .object({ pod: z.string(), name: z.string(), ok: z.boolean(), error: z.string().optional() })
+    .array()
+    .nullable(),
+});
+
+export const zPodAuditEntrySchema = zModelBase.extend({
+  time: z.string(),
+  pod: z.string(),
+  podName: z.string(),
+  // both empty for actions of the control plane itself
+  actor: z.string(),
+  admin: z.string(),
+  action: z.string(),
+  params: z.record(z.unknown()).nullable(),
+  ok: z.boolean(),
+  status: z.number(),
+  error: z.string(),
+  ip: z.string(),
+  expand: z.object({ actor: zUserSchema.partial() }).optional(),
+});
+
+export const zPodUsageTotalsSchema = z.object({
+  seconds: z.number(),
+  cpuSeconds: z.number(),
+  memorySeconds: z.number(),
+});
+
+export const zUserUsageSchema = zPodUsageTotalsSchema.extend({
+  user: z.string(),
+  since: z.string(),
+  weeklyHours: z.number(),
+  pods: zPodUsageTotalsSchema.extend({ pod: z.string(), name: z.string() }).array(),
+});
+
+export const zClassUsageSchema = z.object({
+  class: z.string(),
+  since: z.string(),
+  weeklyHours: z.number(),
+  students: zUserUsageSchema.array(),
+});
+
 export const zFileUploadSchema = z.object({
   attachments: z
     .instanceof(File, { message: 'Select a file' })
@@ -2,7 +2,7 @@ import { redirect, type Load } from '@sveltejs/kit';
 import { pb } from '$lib/pocketbase';
 import { get } from 'svelte/store';
 import { currentUser } from '$lib/stores/user';
-import { zPodServerArraySchema } from './models';
+import { zPodServerArraySchema, zPodTemplateArraySchema } from './models';
 
 export const load: Load = async ({ fetch }) => {
   const user = get(currentUser);
@@ -12,10 +12,16 @@ export const load: Load = async ({ fetch }) => {
 
   const podServersP = pb
     .collection('podServers')
-    .getFullList({ fetch })
+    // draining servers and servers in maintenance take no new pods
+    .getFullList({ fetch, filter: "mode = '' || mode = 'active'" })
     .then((r) => zPodServerArraySchema.parse(r));
 
-  const [podServers] = await Promise.all([podServersP]);
+  const podTemplatesP = pb
+    .collection('podTemplates')
+    .getFullList({ fetch, sort: 'name' })
+    .then((r) => zPodTemplateArraySchema.parse(r));
 
-  return { user, podServers };
+  const [podServers, podTemplates] = await Promise.all([podServersP, podTemplatesP]);
+
+  return { user, podServers, podTemplates };
 };
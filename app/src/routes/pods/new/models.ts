@@ -1,5 +1,11 @@
-import { zMakeErrorDataSchema, zPodSchema, zPodServerSchema } from '$lib/models';
+import {
+  zMakeErrorDataSchema,
+  zPodSchema,
+  zPodServerSchema,
+  zPodTemplateSchema,
+} from '$lib/models';
 
 export const zFormSchema = zPodSchema;
 export const zErrorSchema = zMakeErrorDataSchema(zFormSchema.keyof());
 export const zPodServerArraySchema = zPodServerSchema.array();
+export const zPodTemplateArraySchema = zPodTemplateSchema.array();
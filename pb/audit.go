@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	defaultAuditPerPage = 50
+	maxAuditPerPage     = 500
+)
+
+// Never kept in the parameters of an entry. Auth tokens come in the query
+// for websockets.
+var auditRedactedParams = map[string]struct{}{
+	"token":           {},
+	"password":        {},
+	"passwordConfirm": {},
+}
+
+// Who did what to which pod, and how it went. Entries without an actor or
+// admin were done by the control plane itself (schedules, idle pods, quotas).
+type podAuditEntry struct {
+	pod string
+	// looked up from the pod when empty
+	name   string
+	action string
+	params map[string]any
+	err    error
+	status int
+	time   time.Time
+
+	// nil for the control plane
+	c echo.Context
+}
+
+func auditPod(app *pocketbase.PocketBase, entry podAuditEntry) {
+	if err := saveAuditEntry(app, entry); err != nil {
+		app.Logger().Error("failed to save pod audit entry", "pod", entry.pod, "action", entry.action, "reason", err)
+	}
+}
+
+func saveAuditEntry(app *pocketbase.PocketBase, entry podAuditEntry) error {
+	collection, err := app.Dao().FindCollectionByNameOrId("podAuditLog")
+	if err != nil {
+		return err
+	}
+
+	at, err := types.ParseDateTime(entry.time)
+	if err != nil {
+		return err
+	}
+
+	record := models.NewRecord(collection)
+	record.Set("time", at)
+	record.Set("pod", entry.pod)
+	record.Set("action", entry.action)
+	record.Set("params", entry.params)
+	record.Set("ok", entry.err == nil)
+	record.Set("status", entry.status)
+	if entry.err != nil {
+		record.Set("error", entry.err.Error())
+	}
+
+	// kept after the pod is deleted, so the history still reads
+	name := entry.name
+	if name == "" {
+		if pod, err := app.Dao().FindRecordById("pods", entry.pod); err == nil {
+			name = pod.GetString("name")
+		}
+	}
+
+	record.Set("podName", name)
+
+	if entry.c != nil {
+		info := requestAuthInfo(entry.c)
+		if info.AuthRecord != nil {
+			record.Set("actor", info.AuthRecord.Id)
+		}
+
+		if info.Admin != nil {
+			record.Set("admin", info.Admin.Id)
+		}
+
+		record.Set("ip", entry.c.RealIP())
+	}
+
+	return app.Dao().SaveRecord(record)
+}
+
+func auditPodSystemAction(app *pocketbase.PocketBase, podRecordId, action string, params map[string]any, err error) {
+	auditPod(app, podAuditEntry{
+		pod:    podRecordId,
+		action: action,
+		params: params,
+		err:    err,
+		time:   time.Now(),
+	})
+}
+
+// Records every request to a /api/noroom/pod/:id/* route once it is done,
+// with the time it started at. Has to come after the auth middlewares.
+func middlewareAuditPodAction(app *pocketbase.PocketBase, action string) echo.MiddlewareFunc {
+	return middlewareAuditPod(app, action, podRequestParams)
+}
+
+// Every asset of a proxied page is a request of its own, so only the one
+// exchanging the token for the proxy cookie is recorded. Nothing of the
+// request is kept, its query and body belong to the web app of the pod and
+// may hold anything.
+func middlewareAuditPodProxy(app *pocketbase.PocketBase) echo.MiddlewareFunc {
+	audit := middlewareAuditPod(app, "proxy", func(c echo.Context) map[string]any {
+		return nil
+	})
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		audited := audit(next)
+
+		return func(c echo.Context) error {
+			if token, _ := c.Get(contextQueryTokenKey).(string); token == "" {
+				return next(c)
+			}
+
+			return audited(c)
+		}
+	}
+}
+
+func middlewareAuditPod(app *pocketbase.PocketBase, action string, params func(c echo.Context) map[string]any) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			started := time.Now()
+
+			err := next(c)
+
+			status := c.Response().Status
+			var apiErr *apis.ApiError
+			if errors.As(err, &apiErr) {
+				status = apiErr.Code
+			} else if err != nil {
+				status = http.StatusInternalServerError
+			}
+
+			result := err
+			if result == nil && status >= http.StatusBadRequest {
+				result = fmt.Errorf("request failed with status %d", status)
+			}
+
+			auditPod(app, podAuditEntry{
+				pod:    c.PathParam("id"),
+				action: action,
+				params: params(c),
+				err:    result,
+				status: status,
+				time:   started,
+				c:      c,
+			})
+
+			return err
+		}
+	}
+}
+
+// The query, body and path params of the request, except for the pod id.
+func podRequestParams(c echo.Context) map[string]any {
+	info := apis.RequestInfo(c)
+	params := map[string]any{}
+
+	for k, v := range info.Query {
+		params[k] = v
+	}
+
+	for k, v := range info.Data {
+		params[k] = v
+	}
+
+	for _, name := range c.PathParams() {
+		if name.Name != "id" {
+			params[name.Name] = name.Value
+		}
+	}
+
+	for k := range auditRedactedParams {
+		delete(params, k)
+	}
+
+	return params
+}
+
+func makePodsAfterCreateRequestAudit(app *pocketbase.PocketBase) func(e *core.RecordCreateEvent) error {
+	return func(e *core.RecordCreateEvent) error {
+		auditPod(app, podAuditEntry{
+			pod:    e.Record.Id,
+			action: "create",
+			params: map[string]any{
+				"name":     e.Record.GetString("name"),
+				"image":    e.Record.GetString("image"),
+				"template": e.Record.GetString("template"),
+				"server":   e.Record.GetString("server"),
+				"class":    e.Record.GetString("class"),
+			},
+			time: time.Now(),
+			c:    e.HttpContext,
+		})
+
+		return nil
+	}
+}
+
+// Refreshed from the pod server on every update, see podInspectFields.
+var auditSkippedPodFields = map[string]struct{}{
+	"running":      {},
+	"status":       {},
+	"health":       {},
+	"restartCount": {},
+	"ipAddress":    {},
+	"inspect":      {},
+}
+
+// Only the fields that changed are kept, with their new value.
+func makePodsAfterUpdateRequestAudit(app *pocketbase.PocketBase) func(e *core.RecordUpdateEvent) error {
+	return func(e *core.RecordUpdateEvent) error {
+		original := e.Record.OriginalCopy()
+
+		changed := map[string]any{}
+		for _, field := range e.Record.Collection().Schema.Fields() {
+			if _, ok := auditSkippedPodFields[field.Name]; ok {
+				continue
+			}
+
+			if fmt.Sprint(original.Get(field.Name)) != fmt.Sprint(e.Record.Get(field.Name)) {
+				changed[field.Name] = e.Record.Get(field.Name)
+			}
+		}
+
+		auditPod(app, podAuditEntry{
+			pod:    e.Record.Id,
+			action: "update",
+			params: changed,
+			time:   time.Now(),
+			c:      e.HttpContext,
+		})
+
+		return nil
+	}
+}
+
+func makePodsAfterDeleteRequestAudit(app *pocketbase.PocketBase) func(e *core.RecordDeleteEvent) error {
+	return func(e *core.RecordDeleteEvent) error {
+		auditPod(app, podAuditEntry{
+			pod:    e.Record.Id,
+			name:   e.Record.GetString("name"),
+			action: "delete",
+			time:   time.Now(),
+			c:      e.HttpContext,
+		})
+
+		return nil
+	}
+}
+
+// The history of a pod, newest first, for whoever can see the pod. Admins can
+// filter the whole log through the podAuditLog collection.
+func makeApiNoroomPodAudit(app *pocketbase.PocketBase) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		pod, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		role, err := podRoleOf(app, info, pod)
+		if err != nil {
+			return err
+		}
+
+		if role < podRoleViewer {
+			return apis.NewForbiddenError("", nil)
+		}
+
+		page, _ := strconv.Atoi(c.QueryParam("page"))
+		page = max(page, 1)
+
+		perPage, _ := strconv.Atoi(c.QueryParam("perPage"))
+		if perPage <= 0 {
+			perPage = defaultAuditPerPage
+		}
+		perPage = min(perPage, maxAuditPerPage)
+
+		entries, err := app.Dao().FindRecordsByFilter(
+			"podAuditLog",
+			"pod={:pod}",
+			"-time",
+			perPage,
+			(page-1)*perPage,
+			dbx.Params{"pod": pod.Id},
+		)
+		if err != nil {
+			return err
+		}
+
+		if errs := app.Dao().ExpandRecords(entries, []string{"actor"}, nil); len(errs) > 0 {
+			return fmt.Errorf("failed to expand actors: %v", errs)
+		}
+
+		// where the owner connects from is none of the collaborators' business
+		if role < podRoleOwner {
+			for _, entry := range entries {
+				entry.Set("ip", "")
+			}
+		}
+
+		return c.JSON(http.StatusOK, map[string]any{
+			"page":    page,
+			"perPage": perPage,
+			"items":   entries,
+		})
+	}
+}
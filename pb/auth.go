@@ -1,18 +1,44 @@
 package main
 
 import (
+	"strings"
+
 	"github.com/labstack/echo/v5"
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
 	"github.com/pocketbase/pocketbase/tokens"
 	"github.com/pocketbase/pocketbase/tools/security"
 	"github.com/spf13/cast"
 )
 
+// Where the token given in the query is kept once it is taken out of the
+// request url.
+const contextQueryTokenKey = "noroomQueryToken"
+
 func middlewareLoadAuthContextFromQuery(app *pocketbase.PocketBase) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
+			// protected files are downloaded with a file token of their own, in
+			// the query, which the files api reads itself
+			if strings.HasPrefix(c.Request().URL.Path, "/api/files/") {
+				return next(c)
+			}
+
 			token := c.QueryParam("token")
+			if token != "" {
+				// keeps it out of the request logs, and of whatever the request
+				// is passed on to
+				c.QueryParams().Del("token")
+				c.Request().URL.RawQuery = c.QueryParams().Encode()
+				c.Set(contextQueryTokenKey, token)
+			} else {
+				// only ever sent for the pod proxy paths
+				if cookie, err := c.Cookie(proxyTokenCookie); err == nil {
+					token = cookie.Value
+				}
+			}
+
 			if token == "" {
 				return next(c)
 			}
@@ -43,3 +69,21 @@ func middlewareLoadAuthContextFromQuery(app *pocketbase.PocketBase) echo.Middlew
 		}
 	}
 }
+
+// The auth state of the request, for checking the rules of a record against
+// it. Unlike apis.RequestInfo, neither the query nor the body are bound, a
+// form body would be drained before the request is passed on.
+func requestAuthInfo(c echo.Context) *models.RequestInfo {
+	info := &models.RequestInfo{
+		Context: models.RequestInfoContextDefault,
+		Method:  c.Request().Method,
+		Query:   map[string]any{},
+		Data:    map[string]any{},
+		Headers: map[string]any{},
+	}
+
+	info.AuthRecord, _ = c.Get(apis.ContextAuthRecordKey).(*models.Record)
+	info.Admin, _ = c.Get(apis.ContextAdminKey).(*models.Admin)
+
+	return info
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"noroom/pb/pods"
+	"noroom/rpc"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// How many pods of a class are handled at the same time on each pod server.
+// Different servers work in parallel.
+const classPodsParallelism = 4
+
+const (
+	classPodsStart   = "start"
+	classPodsStop    = "stop"
+	classPodsKill    = "kill"
+	classPodsReset   = "reset"
+	classPodsInspect = "inspect"
+)
+
+type classPodResult struct {
+	Pod   string `json:"pod"`
+	Name  string `json:"name"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	// only for inspect
+	Data *rpc.ContainerInspectExtendedResult `json:"data,omitempty"`
+}
+
+// Runs the action on every pod linked to the class, and reports how it went
+// for each one. Only the owner of the class and editors can do this.
+func makeApiNoroomClassPods(app *pocketbase.PocketBase, pm *pods.PodServerManager, action string) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		class, err := app.Dao().FindRecordById("classes", id)
+		if err != nil {
+			return err
+		}
+
+		if info.AuthRecord.GetString("role") != "editor" && class.GetString("owner") != info.AuthRecord.Id {
+			return apis.NewForbiddenError("", nil)
+		}
+
+		classPods, err := app.Dao().FindRecordsByFilter(
+			"pods",
+			"class={:class}",
+			"name",
+			0,
+			0,
+			dbx.Params{"class": class.Id},
+		)
+		if err != nil {
+			return err
+		}
+
+		results := runOnClassPods(classPods, func(pod *models.Record) (*rpc.ContainerInspectExtendedResult, error) {
+			started := time.Now()
+			data, err := runClassPodAction(app, pm, pod, action)
+
+			auditPod(app, podAuditEntry{
+				pod:    pod.Id,
+				action: action,
+				params: map[string]any{"class": class.Id},
+				err:    err,
+				time:   started,
+				c:      c,
+			})
+
+			return data, err
+		})
+
+		return c.JSON(http.StatusOK, results)
+	}
+}
+
+// Results are in the same order as the pods.
+func runOnClassPods(
+	classPods []*models.Record,
+	fn func(pod *models.Record) (*rpc.ContainerInspectExtendedResult, error),
+) []classPodResult {
+	results := make([]classPodResult, len(classPods))
+
+	// one semaphore per server, so a slow server doesn't hold up the others
+	sems := map[string]chan struct{}{}
+	for _, pod := range classPods {
+		if _, ok := sems[pod.GetString("server")]; !ok {
+			sems[pod.GetString("server")] = make(chan struct{}, classPodsParallelism)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, pod := range classPods {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			sem := sems[pod.GetString("server")]
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			result := classPodResult{Pod: pod.Id, Name: pod.GetString("name")}
+
+			data, err := fn(pod)
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Ok = true
+				result.Data = data
+			}
+
+			results[i] = result
+		}()
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+func runClassPodAction(
+	app *pocketbase.PocketBase,
+	pm *pods.PodServerManager,
+	pod *models.Record,
+	action string,
+) (*rpc.ContainerInspectExtendedResult, error) {
+	if action != classPodsInspect {
+		if err := checkPodNotMigrating(pod); err != nil {
+			return nil, err
+		}
+	}
+
+	if action == classPodsStart {
+		if err := checkPodQuota(app, pod, time.Now()); err != nil {
+			return nil, err
+		}
+
+		if pod.GetString("state") == podStateHibernated {
+			return nil, wakePod(app, pm, pod.Id, true)
+		}
+	}
+
+	podId := pod.GetString("podId")
+	if podId == "" {
+		return nil, errPodNotProvisioned
+	}
+
+	switch action {
+	case classPodsStart:
+		if err := resetPodCrashLoop(app, pm, pod); err != nil {
+			return nil, err
+		}
+
+		if err := pm.StartPodById(podId, defaultStartTimeout); err != nil {
+			return nil, err
+		}
+	case classPodsStop:
+		if err := pm.StopPodById(podId, defaultStartTimeout); err != nil {
+			return nil, err
+		}
+	case classPodsKill:
+		if err := pm.KillPodById(podId, defaultStartTimeout); err != nil {
+			return nil, err
+		}
+	case classPodsReset:
+		if err := resetPod(app, pm, pod); err != nil {
+			return nil, err
+		}
+	case classPodsInspect:
+		data, err := pm.InspectPodById(podId)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := updatePodInspectData(app, pod.Id, data); err != nil {
+			return nil, err
+		}
+
+		return data, nil
+	}
+
+	getAndUpdatePodInspectDataLater(app, pm, pod.Id)
+
+	return nil, nil
+}
+
+// Replaces the container of the pod with a new one from the same spec, so
+// everything outside the home volume is back to how it started. A pod that
+// was running is started again.
+func resetPod(app *pocketbase.PocketBase, pm *pods.PodServerManager, pod *models.Record) error {
+	serverId := pod.GetString("server")
+	wasRunning := pod.GetBool("running")
+
+	if err := pm.DeletePodFromServer(serverId, pod.GetString("podId"), defaultDeleteTimeout); err != nil {
+		return err
+	}
+
+	pod.Set("podId", "")
+	pod.Set("state", podStateProvisioning)
+	pod.Set("provisionError", "")
+	if err := app.Dao().SaveRecord(pod); err != nil {
+		return err
+	}
+
+	if err := provisionPod(app, pm, pod.Id); err != nil {
+		return err
+	}
+
+	if !wasRunning {
+		return nil
+	}
+
+	provisioned, err := app.Dao().FindRecordById("pods", pod.Id)
+	if err != nil {
+		return err
+	}
+
+	return pm.StartPodById(provisioned.GetString("podId"), defaultStartTimeout)
+}
+
+// Students can link their pods to the classes they were present in, so the
+// owner of the class can manage them.
+func canLinkPodToClass(app *pocketbase.PocketBase, user *models.Record, classId string) (bool, error) {
+	if user.GetString("role") == "editor" {
+		return true, nil
+	}
+
+	class, err := app.Dao().FindRecordById("classes", classId)
+	if err != nil {
+		return false, err
+	}
+
+	if class.GetString("owner") == user.Id {
+		return true, nil
+	}
+
+	return wasPresentInClass(app, user.Id, class.Id)
+}
+
+// Students are the users that were present in the class at least once.
+func wasPresentInClass(app *pocketbase.PocketBase, userId, classId string) (bool, error) {
+	_, err := app.Dao().FindFirstRecordByFilter(
+		"classPresenceEntries",
+		"user={:user} && class={:class}",
+		dbx.Params{"user": userId, "class": classId},
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Gets the pod the class provisioned for the student, creating it when this is
+// the first time the student asks for it.
+func makeApiNoroomClassPod(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		class, err := app.Dao().FindRecordById("classes", id)
+		if err != nil {
+			return err
+		}
+
+		present, err := wasPresentInClass(app, info.AuthRecord.Id, class.Id)
+		if err != nil {
+			return err
+		}
+
+		if !present {
+			return apis.NewForbiddenError("not a student of this class", nil)
+		}
+
+		pod, err := ensureClassPod(app, pm, class, info.AuthRecord.Id)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, pod)
+	}
+}
+
+// Provisions the pods of every student of the class at once, ahead of time.
+func makeApiNoroomClassPodsProvision(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		class, err := app.Dao().FindRecordById("classes", id)
+		if err != nil {
+			return err
+		}
+
+		if info.AuthRecord.GetString("role") != "editor" && class.GetString("owner") != info.AuthRecord.Id {
+			return apis.NewForbiddenError("", nil)
+		}
+
+		entries, err := app.Dao().FindRecordsByFilter(
+			"classPresenceEntries",
+			"class={:class}",
+			"",
+			0,
+			0,
+			dbx.Params{"class": class.Id},
+		)
+		if err != nil {
+			return err
+		}
+
+		results := make([]classPodResult, 0, len(entries))
+		for _, entry := range entries {
+			result := classPodResult{}
+
+			pod, err := ensureClassPod(app, pm, class, entry.GetString("user"))
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Pod = pod.Id
+				result.Name = pod.GetString("name")
+				result.Ok = true
+			}
+
+			results = append(results, result)
+		}
+
+		return c.JSON(http.StatusOK, results)
+	}
+}
+
+// Class pods are one per student and class, and don't count towards the
+// maxPods of the student. They are created from the template of the class,
+// on whatever server has room.
+func ensureClassPod(app *pocketbase.PocketBase, pm *pods.PodServerManager, class *models.Record, userId string) (*models.Record, error) {
+	existing, err := app.Dao().FindFirstRecordByFilter(
+		"pods",
+		"class={:class} && student={:student}",
+		dbx.Params{"class": class.Id, "student": userId},
+	)
+	if err == nil {
+		return existing, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if class.GetBool("archived") {
+		return nil, apis.NewBadRequestError("class is archived", nil)
+	}
+
+	templateId := class.GetString("podTemplate")
+	if templateId == "" {
+		return nil, apis.NewBadRequestError("class has no pod template", nil)
+	}
+
+	template, err := app.Dao().FindRecordById("podTemplates", templateId)
+	if err != nil {
+		return nil, err
+	}
+
+	serverId, err := pickPodServer(app)
+	if err != nil {
+		return nil, err
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId("pods")
+	if err != nil {
+		return nil, err
+	}
+
+	pod := models.NewRecord(collection)
+	pod.Set("name", fmt.Sprintf("class-%s-%s", class.Id, userId))
+	pod.Set("image", template.GetString("image"))
+	pod.Set("template", template.Id)
+	pod.Set("server", serverId)
+	pod.Set("class", class.Id)
+	pod.Set("student", userId)
+	pod.Set("owner", userId)
+	pod.Set("volume", newHomeVolumeName(userId))
+	pod.Set("state", podStateProvisioning)
+
+	// the unique index on class and student keeps concurrent first visits
+	// from creating two pods
+	if err := app.Dao().SaveRecord(pod); err != nil {
+		existing, findErr := app.Dao().FindFirstRecordByFilter(
+			"pods",
+			"class={:class} && student={:student}",
+			dbx.Params{"class": class.Id, "student": userId},
+		)
+		if findErr != nil {
+			return nil, err
+		}
+
+		return existing, nil
+	}
+
+	provisionPodLater(app, pm, pod.Id)
+
+	return pod, nil
+}
+
+func makeClassesAfterUpdateRequest(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(e *core.RecordUpdateEvent) error {
+	return func(e *core.RecordUpdateEvent) error {
+		if e.Record.GetBool("archived") && !e.Record.OriginalCopy().GetBool("archived") {
+			go cleanupClassPods(app, pm, e.Record.Id)
+		}
+
+		return nil
+	}
+}
+
+// Deletes the pods provisioned for the students of an archived class. Pods the
+// students linked to the class themselves are left alone.
+func cleanupClassPods(app *pocketbase.PocketBase, pm *pods.PodServerManager, classId string) {
+	classPods, err := app.Dao().FindRecordsByFilter(
+		"pods",
+		"class={:class} && student!=''",
+		"",
+		0,
+		0,
+		dbx.Params{"class": classId},
+	)
+	if err != nil {
+		app.Logger().Error("failed to find pods of archived class", "class", classId, "reason", err)
+		return
+	}
+
+	for _, pod := range classPods {
+		if err := app.Dao().DeleteRecord(pod); err != nil {
+			app.Logger().Error("failed to delete pod of archived class", "class", classId, "pod", pod.Id, "reason", err)
+			continue
+		}
+
+		cleanupDeletedPod(app, pm, pod)
+	}
+}
+
+// Pods provisioned by a class have their own quota.
+func countPersonalPods(app *pocketbase.PocketBase, user *models.Record) (int, error) {
+	var count int
+	err := app.Dao().DB().
+		Select("count(*)").
+		From("pods").
+		Where(dbx.HashExp{"owner": user.Id, "student": ""}).
+		Row(&count)
+
+	return count, err
+}
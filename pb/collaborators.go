@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// What a user may do with a pod, each role can do everything the ones before
+// it can.
+type podRole int
+
+const (
+	podRoleNone podRole = iota
+	// attaches read-only, inspects and reads the audit log
+	podRoleViewer
+	// starts, stops, attaches read-write, takes and lists snapshots and
+	// hibernates
+	podRoleOperator
+	// the owner of the pod, and editors. Anything the update rule allows,
+	// restoring and deleting snapshots and watching recordings included.
+	podRoleOwner
+)
+
+const (
+	collaboratorViewer   = "viewer"
+	collaboratorOperator = "operator"
+)
+
+func podRoleOf(app *pocketbase.PocketBase, info *models.RequestInfo, pod *models.Record) (podRole, error) {
+	if canUpdate, _ := app.Dao().CanAccessRecord(pod, info, pod.Collection().UpdateRule); canUpdate {
+		return podRoleOwner, nil
+	}
+
+	if info.AuthRecord == nil {
+		return podRoleNone, nil
+	}
+
+	collaborator, err := findPodCollaborator(app, pod.Id, info.AuthRecord.Id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return podRoleNone, nil
+	} else if err != nil {
+		return podRoleNone, err
+	}
+
+	switch collaborator.GetString("role") {
+	case collaboratorOperator:
+		return podRoleOperator, nil
+	case collaboratorViewer:
+		return podRoleViewer, nil
+	default:
+		return podRoleNone, nil
+	}
+}
+
+func requirePodRole(app *pocketbase.PocketBase, info *models.RequestInfo, pod *models.Record, need podRole) error {
+	role, err := podRoleOf(app, info, pod)
+	if err != nil {
+		return err
+	}
+
+	if role < need {
+		return apis.NewForbiddenError("", nil)
+	}
+
+	return nil
+}
+
+func findPodCollaborator(app *pocketbase.PocketBase, podRecordId, userId string) (*models.Record, error) {
+	return app.Dao().FindFirstRecordByFilter(
+		"podCollaborators",
+		"pod={:pod} && user={:user}",
+		dbx.Params{"pod": podRecordId, "user": userId},
+	)
+}
+
+// Adds a collaborator to the pod, or changes the role of one. Only the owner
+// of the pod and editors can do this.
+func makeApiNoroomPodCollaboratorInvite(app *pocketbase.PocketBase, validate *validator.Validate) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		type bodyModel struct {
+			User string `json:"user" validate:"required"`
+			Role string `json:"role" validate:"required,oneof=viewer operator"`
+		}
+
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		var body bodyModel
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+
+		if err := validate.Struct(body); err != nil {
+			return err
+		}
+
+		pod, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		if err := requirePodRole(app, info, pod, podRoleOwner); err != nil {
+			return err
+		}
+
+		user, err := app.Dao().FindRecordById("users", body.User)
+		if err != nil {
+			return apis.NewBadRequestError("invalid user", err)
+		}
+
+		if user.Id == pod.GetString("owner") {
+			return apis.NewBadRequestError("the owner of a pod can't be a collaborator", nil)
+		}
+
+		collaborator, err := findPodCollaborator(app, pod.Id, user.Id)
+		if errors.Is(err, sql.ErrNoRows) {
+			collection, err := app.Dao().FindCollectionByNameOrId("podCollaborators")
+			if err != nil {
+				return err
+			}
+
+			collaborator = models.NewRecord(collection)
+			collaborator.Set("pod", pod.Id)
+			collaborator.Set("user", user.Id)
+		} else if err != nil {
+			return err
+		}
+
+		collaborator.Set("role", body.Role)
+		collaborator.Set("invitedBy", info.AuthRecord.Id)
+
+		if err := app.Dao().SaveRecord(collaborator); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, collaborator)
+	}
+}
+
+// Collaborators can also remove themselves.
+func makeApiNoroomPodCollaboratorRemove(app *pocketbase.PocketBase) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		userId := c.PathParam("user")
+		if id == "" || userId == "" {
+			return apis.NewBadRequestError("missing id or user", nil)
+		}
+
+		pod, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		if info.AuthRecord.Id != userId {
+			if err := requirePodRole(app, info, pod, podRoleOwner); err != nil {
+				return err
+			}
+		}
+
+		collaborator, err := findPodCollaborator(app, pod.Id, userId)
+		if err != nil {
+			return apis.NewNotFoundError("", err)
+		}
+
+		if err := app.Dao().DeleteRecord(collaborator); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
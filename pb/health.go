@@ -0,0 +1,34 @@
+package main
+
+import (
+	"noroom/pb/pods"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Keeps the status of every pod server up to date on its record. Only the
+// health columns are written, so admin changes made meanwhile (mode,
+// drainDeadline...) are never overwritten. A server deleted while the check
+// ran simply matches no row.
+func makeOnServerHealth(app *pocketbase.PocketBase) func(serverId string, health pods.ServerHealth) {
+	return func(serverId string, health pods.ServerHealth) {
+		params := dbx.Params{
+			"status":    health.Status,
+			"latency":   health.Latency.Milliseconds(),
+			"lastError": health.LastError,
+		}
+
+		if !health.LastSeen.IsZero() {
+			lastSeen, err := types.ParseDateTime(health.LastSeen)
+			if err == nil {
+				params["lastSeen"] = lastSeen
+			}
+		}
+
+		if _, err := app.Dao().DB().Update("podServers", params, dbx.HashExp{"id": serverId}).Execute(); err != nil {
+			app.Logger().Error("failed to save pod server health", "server", serverId, "reason", err)
+		}
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"noroom/pb/pods"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Hibernated pods have no container, volume or snapshot image on any pod
+// server. Everything they had lives in an archive of a snapshot kept on the
+// pod record, until they are woken up.
+const (
+	podStateHibernating = "hibernating"
+	podStateHibernated  = "hibernated"
+	podStateWaking      = "waking"
+)
+
+const (
+	hibernateCheckInterval = time.Hour
+	hibernateSnapshotTag   = "hibernated"
+)
+
+var (
+	errPodHibernated     = errors.New("pod is hibernated, start it to wake it up")
+	errPodNotHibernating = errors.New("pod is not ready to be hibernated")
+	errPodNotHibernated  = errors.New("pod is not hibernated")
+)
+
+// Hibernates a stopped pod right away, without waiting for its template's
+// hibernateAfterDays. The pod is hibernated in the background.
+func makeApiNoroomPodHibernate(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		pod, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		if err := requirePodRole(app, info, pod, podRoleOperator); err != nil {
+			return err
+		}
+
+		if err := checkCanHibernate(pod); err != nil {
+			return apis.NewBadRequestError("", err)
+		}
+
+		if pod.GetBool("running") {
+			return apis.NewBadRequestError("stop the pod before hibernating it", nil)
+		}
+
+		go func() {
+			if err := hibernatePod(app, pm, id); err != nil {
+				app.Logger().Error("failed to hibernate pod", "pod", id, "reason", err)
+			}
+		}()
+
+		return c.NoContent(http.StatusAccepted)
+	}
+}
+
+func checkCanHibernate(pod *models.Record) error {
+	if pod.GetString("podId") == "" {
+		return errPodNotProvisioned
+	}
+
+	if err := checkPodNotMigrating(pod); err != nil {
+		return err
+	}
+
+	if state := pod.GetString("state"); state != "" && state != podStateReady {
+		return errPodNotHibernating
+	}
+
+	return nil
+}
+
+// Moves the pod to hibernating only if nothing else took it since it was
+// read, so the endpoint and the hourly sweep never hibernate it twice.
+func claimPodForHibernation(app *pocketbase.PocketBase, id string) error {
+	claimed, err := updatePodIf(
+		app,
+		id,
+		dbx.Params{"state": podStateHibernating},
+		dbx.In("state", "", podStateReady),
+		dbx.Not(dbx.HashExp{"migrationStatus": migrationRunning}),
+	)
+	if err != nil {
+		return err
+	}
+
+	if !claimed {
+		return errPodNotHibernating
+	}
+
+	return nil
+}
+
+// Same for waking, so two starts of a hibernated pod (or a schedule and a
+// class start) only bring it back once.
+func claimPodForWaking(app *pocketbase.PocketBase, id string) error {
+	claimed, err := updatePodIf(
+		app,
+		id,
+		dbx.Params{"state": podStateWaking, "provisionError": ""},
+		dbx.HashExp{"state": podStateHibernated},
+	)
+	if err != nil {
+		return err
+	}
+
+	if !claimed {
+		return errPodNotHibernated
+	}
+
+	return nil
+}
+
+// Updates the columns of the pod only when it matches every condition,
+// reporting whether it did.
+func updatePodIf(app *pocketbase.PocketBase, id string, params dbx.Params, conds ...dbx.Expression) (bool, error) {
+	params["updated"] = types.NowDateTime()
+
+	result, err := app.Dao().DB().
+		Update("pods", params, dbx.And(append([]dbx.Expression{dbx.HashExp{"id": id}}, conds...)...)).
+		Execute()
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return updated > 0, nil
+}
+
+// The archive holds the whole filesystem and home of the pod, so it is only
+// for its owner and editors. Collaborators pass the view rule, which is all
+// PocketBase checks for protected files.
+func makePodsFileDownloadRequest(app *pocketbase.PocketBase) func(e *core.FileDownloadEvent) error {
+	return func(e *core.FileDownloadEvent) error {
+		if e.FileField.Name != "hibernationArchive" {
+			return nil
+		}
+
+		token := e.HttpContext.QueryParam("token")
+
+		admin, err := app.Dao().FindAdminByToken(token, app.Settings().AdminFileToken.Secret)
+		if err == nil && admin != nil {
+			return nil
+		}
+
+		user, err := app.Dao().FindAuthRecordByToken(token, app.Settings().RecordFileToken.Secret)
+		if err != nil {
+			return apis.NewForbiddenError("", nil)
+		}
+
+		return requirePodRole(app, &models.RequestInfo{AuthRecord: user}, e.Record, podRoleOwner)
+	}
+}
+
+// Wakes a hibernated pod in the background, and starts it once it is back.
+func wakePodLater(app *pocketbase.PocketBase, pm *pods.PodServerManager, id string) {
+	go func() {
+		if err := wakePod(app, pm, id, true); err != nil {
+			app.Logger().Error("failed to wake pod", "pod", id, "reason", err)
+		}
+	}()
+}
+
+// Snapshots the pod (home volume included), moves the snapshot to an archive
+// on the pod record and removes everything the pod had on its server. The pod
+// is left as it was when a step fails before the archive is saved.
+func hibernatePod(app *pocketbase.PocketBase, pm *pods.PodServerManager, id string) error {
+	pod, err := app.Dao().FindRecordById("pods", id)
+	if err != nil {
+		return err
+	}
+
+	if err := checkCanHibernate(pod); err != nil {
+		return err
+	}
+
+	serverId := pod.GetString("server")
+	podId := pod.GetString("podId")
+	state := pod.GetString("state")
+
+	if err := claimPodForHibernation(app, id); err != nil {
+		return err
+	}
+
+	var image string
+
+	rollback := func(cause error) error {
+		if image != "" {
+			if err := pm.DeleteSnapshotFromServer(serverId, image); err != nil {
+				app.Logger().Error("failed to delete hibernation snapshot", "podServer", serverId, "pod", id, "reason", err)
+			}
+		}
+
+		current, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return errors.Join(cause, err)
+		}
+
+		current.Set("state", state)
+
+		return errors.Join(cause, app.Dao().SaveRecord(current))
+	}
+
+	if err := pm.StopPodById(podId, defaultStartTimeout); err != nil {
+		return rollback(fmt.Errorf("failed to stop pod: %w", err))
+	}
+
+	image, err = pm.SnapshotPodById(podId, pod.Id, hibernateSnapshotTag, defaultSnapshotTimeout)
+	if err != nil {
+		return rollback(fmt.Errorf("failed to snapshot pod: %w", err))
+	}
+
+	path, err := exportSnapshotToFile(pm, serverId, image)
+	if err != nil {
+		return rollback(fmt.Errorf("failed to export snapshot: %w", err))
+	}
+
+	defer os.Remove(path)
+
+	file, err := filesystem.NewFileFromPath(path)
+	if err != nil {
+		return rollback(err)
+	}
+
+	// read again, settings may have changed while the snapshot was exported
+	current, err := app.Dao().FindRecordById("pods", id)
+	if err != nil {
+		return rollback(err)
+	}
+
+	form := forms.NewRecordUpsert(app, current)
+	form.LoadData(map[string]any{
+		"podId":           "",
+		"state":           podStateHibernated,
+		"provisionError":  "",
+		"hibernatedImage": image,
+		"running":         false,
+		"status":          podStateHibernated,
+	})
+
+	if err := form.AddFiles("hibernationArchive", file); err != nil {
+		return rollback(err)
+	}
+
+	if err := form.Submit(); err != nil {
+		return rollback(fmt.Errorf("failed to save hibernation archive: %w", err))
+	}
+
+	// from here on the pod lives in the archive, failures only leave garbage
+	deletePodAndVolumeFromServer(app, pm, serverId, podId, pod.GetString("volume"))
+
+	if err := pm.DeleteSnapshotFromServer(serverId, image); err != nil {
+		app.Logger().Error("failed to delete hibernation snapshot", "podServer", serverId, "pod", id, "reason", err)
+	}
+
+	app.Logger().Info("hibernated pod", "pod", id)
+
+	return nil
+}
+
+// Exports are streamed to a temporary file first, the record form only takes
+// files.
+func exportSnapshotToFile(pm *pods.PodServerManager, serverId, image string) (string, error) {
+	archive, err := pm.ExportSnapshotFromServer(serverId, image)
+	if err != nil {
+		return "", err
+	}
+
+	defer archive.Close()
+
+	f, err := os.CreateTemp("", "noroom-hibernation-*.tar")
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	if _, err := io.Copy(f, archive); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// Brings a hibernated pod back on its old server, or on any other server that
+// takes pods. The home volume is created empty, so docker fills it with the
+// contents saved in the snapshot. A pod that fails to wake up stays
+// hibernated, with the reason in provisionError.
+func wakePod(app *pocketbase.PocketBase, pm *pods.PodServerManager, id string, start bool) error {
+	pod, err := app.Dao().FindRecordById("pods", id)
+	if err != nil {
+		return err
+	}
+
+	if err := claimPodForWaking(app, id); err != nil {
+		return err
+	}
+
+	var (
+		serverId string
+		imported bool
+		newPodId string
+	)
+
+	image := pod.GetString("hibernatedImage")
+
+	rollback := func(cause error) error {
+		if imported {
+			deletePodAndVolumeFromServer(app, pm, serverId, newPodId, pod.GetString("volume"))
+
+			if err := pm.DeleteSnapshotFromServer(serverId, image); err != nil {
+				app.Logger().Error("failed to delete hibernation snapshot", "podServer", serverId, "pod", id, "reason", err)
+			}
+		}
+
+		current, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return errors.Join(cause, err)
+		}
+
+		current.Set("state", podStateHibernated)
+		current.Set("provisionError", cause.Error())
+
+		return errors.Join(cause, app.Dao().SaveRecord(current))
+	}
+
+	serverId, err = pickWakeServer(app, pod.GetString("server"))
+	if err != nil {
+		return rollback(fmt.Errorf("no server to wake the pod on: %w", err))
+	}
+
+	if err := importHibernationArchive(app, pm, pod, serverId); err != nil {
+		return rollback(fmt.Errorf("failed to import snapshot: %w", err))
+	}
+
+	imported = true
+
+	spec, err := podSpecFromRecord(app, pod)
+	if err != nil {
+		return rollback(err)
+	}
+
+	// the snapshot has everything the pod had, files included
+	spec.Image = image
+	spec.Files = nil
+
+	newPodId, err = pm.AddNewPodToServer(serverId, spec)
+	if err != nil {
+		return rollback(fmt.Errorf("failed to create pod: %w", err))
+	}
+
+	if start {
+		if err := pm.StartPodById(newPodId, defaultStartTimeout); err != nil {
+			return rollback(fmt.Errorf("failed to start pod: %w", err))
+		}
+	}
+
+	current, err := app.Dao().FindRecordById("pods", id)
+	if err != nil {
+		return rollback(err)
+	}
+
+	form := forms.NewRecordUpsert(app, current)
+	form.LoadData(map[string]any{
+		"server":          serverId,
+		"podId":           newPodId,
+		"state":           podStateReady,
+		"provisionError":  "",
+		"hibernatedImage": "",
+	})
+
+	if err := form.RemoveFiles("hibernationArchive"); err != nil {
+		return rollback(err)
+	}
+
+	if err := form.Submit(); err != nil {
+		return rollback(fmt.Errorf("failed to switch pod: %w", err))
+	}
+
+	// snapshots of the pod made before it hibernated were left on the old
+	// server, they can't be restored on another one
+	if old := pod.GetString("server"); old != serverId {
+		deletePodSnapshots(app, pm, old, pod.Id)
+	}
+
+	app.Logger().Info("woke up pod", "pod", id, "podServer", serverId)
+	getAndUpdatePodInspectDataLater(app, pm, id)
+
+	return nil
+}
+
+// The old server of the pod is preferred, its snapshots are still there.
+func pickWakeServer(app *pocketbase.PocketBase, serverId string) (string, error) {
+	if serverId != "" && checkServerTakesPods(app, serverId) == nil {
+		server, err := app.Dao().FindRecordById("podServers", serverId)
+		if err == nil && server.GetString("status") != pods.ServerStatusOffline {
+			return serverId, nil
+		}
+	}
+
+	return pickPodServer(app)
+}
+
+func importHibernationArchive(app *pocketbase.PocketBase, pm *pods.PodServerManager, pod *models.Record, serverId string) error {
+	fsys, err := app.NewFilesystem()
+	if err != nil {
+		return err
+	}
+
+	defer fsys.Close()
+
+	archive, err := fsys.GetFile(pod.BaseFilesPath() + "/" + pod.GetString("hibernationArchive"))
+	if err != nil {
+		return err
+	}
+
+	defer archive.Close()
+
+	return pm.ImportSnapshotToServer(serverId, archive)
+}
+
+func watchHibernatingPods(app *pocketbase.PocketBase, pm *pods.PodServerManager) {
+	for range time.Tick(hibernateCheckInterval) {
+		if err := hibernateUnusedPods(app, pm); err != nil {
+			app.Logger().Error("failed to check pods to hibernate", "reason", err)
+		}
+	}
+}
+
+// Only stopped pods whose template has hibernateAfterDays are ever
+// hibernated. A pod counts as unused since it last stopped, or since it was
+// created when it never ran.
+func hibernateUnusedPods(app *pocketbase.PocketBase, pm *pods.PodServerManager) error {
+	stopped, err := app.Dao().FindRecordsByFilter(
+		"pods",
+		"running=false && podId!='' && (state='' || state={:ready}) && migrationStatus!={:migrating} && template.hibernateAfterDays>0",
+		"",
+		0,
+		0,
+		dbx.Params{"ready": podStateReady, "migrating": migrationRunning},
+	)
+	if err != nil {
+		return err
+	}
+
+	if errs := app.Dao().ExpandRecords(stopped, []string{"template"}, nil); len(errs) > 0 {
+		return fmt.Errorf("failed to expand templates: %v", errs)
+	}
+
+	for _, pod := range stopped {
+		template := pod.ExpandedOne("template")
+		if template == nil {
+			continue
+		}
+
+		data, err := pm.InspectPodById(pod.GetString("podId"))
+		if err != nil {
+			app.Logger().Error("failed to inspect pod to hibernate", "pod", pod.Id, "reason", err)
+			continue
+		}
+
+		// the record may be behind
+		if data.State.Running {
+			continue
+		}
+
+		lastUsed := pod.Created.Time()
+		if finished, err := time.Parse(time.RFC3339Nano, data.State.FinishedAt); err == nil && finished.After(lastUsed) {
+			lastUsed = finished
+		}
+
+		after := time.Duration(template.GetInt("hibernateAfterDays")) * 24 * time.Hour
+		if time.Since(lastUsed) < after {
+			continue
+		}
+
+		err = hibernatePod(app, pm, pod.Id)
+		auditPodSystemAction(app, pod.Id, "hibernate", map[string]any{"reason": "unused", "lastUsed": lastUsed}, err)
+		if err != nil {
+			app.Logger().Error("failed to hibernate unused pod", "pod", pod.Id, "reason", err)
+		}
+	}
+
+	return nil
+}
+
+// Hibernating and waking don't survive a restart. Nothing is removed from the
+// pod server before the archive is saved, so a pod that was hibernating is
+// still ready, and a pod that was waking is still hibernated.
+func failInterruptedHibernations(app *pocketbase.PocketBase) error {
+	interrupted, err := app.Dao().FindRecordsByFilter(
+		"pods",
+		"state={:hibernating} || state={:waking}",
+		"",
+		0,
+		0,
+		dbx.Params{"hibernating": podStateHibernating, "waking": podStateWaking},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range interrupted {
+		app.Logger().Warn("pod hibernation was interrupted", "pod", pod.Id, "state", pod.GetString("state"))
+
+		if pod.GetString("state") == podStateHibernating {
+			pod.Set("state", podStateReady)
+		} else {
+			pod.Set("state", podStateHibernated)
+			pod.Set("provisionError", "interrupted by a restart")
+		}
+
+		if err := app.Dao().SaveRecord(pod); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
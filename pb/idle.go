@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"noroom/pb/pods"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+const (
+	idleCheckInterval = time.Second * 30
+	// how long before stopping an idle pod its terminals are warned
+	idleWarning = time.Minute
+)
+
+// Keeps track of when each running pod was last used, in memory. A pod counts
+// as used while bytes go through its terminal, and optionally while it uses
+// CPU.
+type idleTracker struct {
+	pods  map[string]*podActivity
+	mutex sync.Mutex
+}
+
+type podActivity struct {
+	last   time.Time
+	warned bool
+
+	// the previous CPU sample
+	cpuUsage uint64
+	cpuRead  time.Time
+}
+
+func newIdleTracker() *idleTracker {
+	return &idleTracker{pods: map[string]*podActivity{}}
+}
+
+// Marks the pod (by record id) as used right now.
+func (t *idleTracker) touch(id string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.get(id).touch()
+}
+
+// Pods the tracker hasn't seen before start out as just used.
+func (t *idleTracker) get(id string) *podActivity {
+	a, ok := t.pods[id]
+	if !ok {
+		a = &podActivity{last: time.Now()}
+		t.pods[id] = a
+	}
+
+	return a
+}
+
+// Forgets every pod not in keep, so a pod that is started again starts over.
+func (t *idleTracker) retain(keep map[string]struct{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for id := range t.pods {
+		if _, ok := keep[id]; !ok {
+			delete(t.pods, id)
+		}
+	}
+}
+
+func (a *podActivity) touch() {
+	a.last = time.Now()
+	a.warned = false
+}
+
+func watchIdlePods(app *pocketbase.PocketBase, pm *pods.PodServerManager, sm *pods.SessionManager, tracker *idleTracker) {
+	for range time.Tick(idleCheckInterval) {
+		if err := stopIdlePods(app, pm, sm, tracker); err != nil {
+			app.Logger().Error("failed to check idle pods", "reason", err)
+		}
+	}
+}
+
+// Only pods whose template has an idle timeout are ever stopped.
+func stopIdlePods(app *pocketbase.PocketBase, pm *pods.PodServerManager, sm *pods.SessionManager, tracker *idleTracker) error {
+	running, err := app.Dao().FindRecordsByFilter("pods", "running=true && template.idleTimeout>0", "", 0, 0)
+	if err != nil {
+		return err
+	}
+
+	if errs := app.Dao().ExpandRecords(running, []string{"template"}, nil); len(errs) > 0 {
+		return fmt.Errorf("failed to expand templates: %v", errs)
+	}
+
+	keep := map[string]struct{}{}
+	for _, pod := range running {
+		keep[pod.Id] = struct{}{}
+
+		template := pod.ExpandedOne("template")
+		if template == nil {
+			continue
+		}
+
+		checkIdlePod(app, pm, sm, tracker, pod, template)
+	}
+
+	tracker.retain(keep)
+
+	return nil
+}
+
+func checkIdlePod(
+	app *pocketbase.PocketBase,
+	pm *pods.PodServerManager,
+	sm *pods.SessionManager,
+	tracker *idleTracker,
+	pod, template *models.Record,
+) {
+	podId := pod.GetString("podId")
+	timeout := time.Duration(template.GetInt("idleTimeout")) * time.Minute
+
+	// sampled outside the lock, the pod server may be slow
+	var busy bool
+	if threshold := template.GetFloat("idleCpuPercent"); threshold > 0 {
+		stats, err := pm.StatsPodById(podId)
+		if err != nil {
+			app.Logger().Error("failed to get pod stats", "pod", pod.Id, "reason", err)
+		} else {
+			busy = tracker.sampleCPU(pod.Id, stats.CPUUsage, stats.Read, threshold)
+		}
+	}
+
+	tracker.mutex.Lock()
+	a := tracker.get(pod.Id)
+	if busy {
+		a.touch()
+	}
+
+	idle := time.Since(a.last)
+	warn := idle >= timeout-idleWarning && !a.warned
+	if warn {
+		a.warned = true
+	}
+	tracker.mutex.Unlock()
+
+	if idle >= timeout {
+		sm.Notify(podId, "this pod was idle for too long and is being stopped")
+
+		err := pm.StopPodById(podId, defaultStartTimeout)
+		auditPodSystemAction(app, pod.Id, "stop", map[string]any{"reason": "idle", "idle": idle.String()}, err)
+		if err != nil {
+			app.Logger().Error("failed to stop idle pod", "pod", pod.Id, "reason", err)
+			return
+		}
+
+		app.Logger().Info("stopped idle pod", "pod", pod.Id, "idle", idle.String())
+		getAndUpdatePodInspectDataLater(app, pm, pod.Id)
+
+		return
+	}
+
+	if warn {
+		sm.Notify(podId, fmt.Sprintf("this pod is idle and will be stopped in %s, use it to keep it running", (timeout-idle).Round(time.Second)))
+	}
+}
+
+// Reports whether the pod used more than threshold percent of a CPU since the
+// previous sample.
+func (t *idleTracker) sampleCPU(id string, usage uint64, read time.Time, threshold float64) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	a := t.get(id)
+	prevUsage, prevRead := a.cpuUsage, a.cpuRead
+	a.cpuUsage, a.cpuRead = usage, read
+
+	if prevRead.IsZero() || !read.After(prevRead) || usage < prevUsage {
+		return false
+	}
+
+	percent := float64(usage-prevUsage) / float64(read.Sub(prevRead).Nanoseconds()) * 100
+
+	return percent > threshold
+}
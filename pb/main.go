@@ -20,7 +20,29 @@ import (
 func main() {
 	app := pocketbase.New()
 
+	recordings := &recordingSettings{}
+	app.RootCmd.PersistentFlags().DurationVar(
+		&recordings.maxAge,
+		"recordingsMaxAge",
+		defaultRecordingsMaxAge,
+		"how long terminal session recordings are kept (0 to keep forever)",
+	)
+	app.RootCmd.PersistentFlags().IntVar(
+		&recordings.maxPerPod,
+		"recordingsMaxPerPod",
+		defaultRecordingsMaxPerPod,
+		"how many terminal session recordings are kept per pod (0 for no limit)",
+	)
+
 	podman := pods.NewPodServerManager()
+	sessions := pods.NewSessionManager(podman, pods.SessionHooks{
+		OnStart: makeOnSessionStart(app, recordings),
+		OnEnd:   makeOnSessionEnd(app, podman),
+	})
+	podman.OnContainerEvent(makeOnContainerEvent(app, podman))
+	podman.OnServerHealth(makeOnServerHealth(app))
+
+	idle := newIdleTracker()
 
 	validate := validator.New(validator.WithRequiredStructEnabled())
 
@@ -33,37 +55,117 @@ func main() {
 
 		e.Router.POST("/api/noroom/presence", makeApiNoroomPresence(app, validate), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
 
-		e.Router.POST("/api/noroom/pod/:id/start", makeApiNoroomPodStart(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
-		e.Router.POST("/api/noroom/pod/:id/stop", makeApiNoroomPodStop(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
-		e.Router.POST("/api/noroom/pod/:id/kill", makeApiNoroomPodKill(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
-		e.Router.POST("/api/noroom/pod/:id/inspect", makeApiNoroomPodInspect(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
-		e.Router.GET("/api/noroom/pod/:id/attach", makeApiNoroomPodAttach(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
+		e.Router.GET("/api/noroom/usage", makeApiNoroomUsage(app), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
+
+		e.Router.POST("/api/noroom/pod/:id/start", makeApiNoroomPodStart(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "start"))
+		e.Router.POST("/api/noroom/pod/:id/stop", makeApiNoroomPodStop(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "stop"))
+		e.Router.POST("/api/noroom/pod/:id/kill", makeApiNoroomPodKill(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "kill"))
+		e.Router.POST("/api/noroom/pod/:id/inspect", makeApiNoroomPodInspect(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "inspect"))
+		e.Router.GET("/api/noroom/pod/:id/attach", makeApiNoroomPodAttach(app, sessions, idle), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "attach"))
+		e.Router.GET("/api/noroom/pod/:id/viewers", makeApiNoroomPodViewers(app, sessions), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "viewers"))
+		e.Router.POST("/api/noroom/pod/:id/resize", makeApiNoroomPodResize(app, podman, sessions, validate), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "resize"))
+		e.Router.GET("/api/noroom/pod/:id/recordings/:recording/cast", makeApiNoroomPodRecordingCast(app), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "recordingCast"))
+		e.Router.Any("/api/noroom/pod/:id/proxy/:port/*", makeApiNoroomPodProxy(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodProxy(app))
+
+		e.Router.POST("/api/noroom/pod/:id/migrate", makeApiNoroomPodMigrate(app, podman, validate), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "migrate"))
+		e.Router.POST("/api/noroom/pod/:id/hibernate", makeApiNoroomPodHibernate(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "hibernate"))
+		e.Router.POST("/api/noroom/pod/:id/collaborators", makeApiNoroomPodCollaboratorInvite(app, validate), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "collaboratorInvite"))
+		e.Router.DELETE("/api/noroom/pod/:id/collaborators/:user", makeApiNoroomPodCollaboratorRemove(app), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "collaboratorRemove"))
+		e.Router.POST("/api/noroom/pod/:id/transfer", makeApiNoroomPodTransfer(app, validate), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "transfer"))
+		e.Router.GET("/api/noroom/pod/:id/audit", makeApiNoroomPodAudit(app), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
+
+		e.Router.GET("/api/noroom/pod/:id/snapshots", makeApiNoroomPodSnapshotList(app), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "snapshotList"))
+		e.Router.POST("/api/noroom/pod/:id/snapshots", makeApiNoroomPodSnapshotCreate(app, podman, validate), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "snapshotCreate"))
+		e.Router.POST("/api/noroom/pod/:id/snapshots/:snapshot/restore", makeApiNoroomPodSnapshotRestore(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "snapshotRestore"))
+		e.Router.DELETE("/api/noroom/pod/:id/snapshots/:snapshot", makeApiNoroomPodSnapshotDelete(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"), middlewareAuditPodAction(app, "snapshotDelete"))
+
+		e.Router.POST("/api/noroom/class/:id/pod", makeApiNoroomClassPod(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
+		e.Router.GET("/api/noroom/class/:id/usage", makeApiNoroomClassUsage(app), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
+		e.Router.POST("/api/noroom/class/:id/pods/provision", makeApiNoroomClassPodsProvision(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
+		e.Router.POST("/api/noroom/class/:id/pods/start", makeApiNoroomClassPods(app, podman, classPodsStart), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
+		e.Router.POST("/api/noroom/class/:id/pods/stop", makeApiNoroomClassPods(app, podman, classPodsStop), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
+		e.Router.POST("/api/noroom/class/:id/pods/kill", makeApiNoroomClassPods(app, podman, classPodsKill), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
+		e.Router.POST("/api/noroom/class/:id/pods/reset", makeApiNoroomClassPods(app, podman, classPodsReset), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
+		e.Router.POST("/api/noroom/class/:id/pods/inspect", makeApiNoroomClassPods(app, podman, classPodsInspect), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
+
+		e.Router.GET("/api/noroom/podServer/:id/volumes", makeApiNoroomVolumeList(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
+		e.Router.GET("/api/noroom/podServer/:id/volumes/:name/size", makeApiNoroomVolumeSize(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
+		e.Router.GET("/api/noroom/podServer/:id/volumes/:name/backup", makeApiNoroomVolumeBackup(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
+		e.Router.DELETE("/api/noroom/podServer/:id/volumes/:name", makeApiNoroomVolumeDelete(app, podman), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
+		e.Router.GET("/api/noroom/podServer/:id/remaining", makeApiNoroomPodServerRemaining(app), apis.ActivityLogger(app), apis.RequireRecordAuth("users"))
 
 		if err := checkAndMigrateUsersToHavePods(app); err != nil {
 			app.Logger().Error("failed to migrate users", "reason", err)
 			return err
 		}
 
+		if err := checkAndMigratePodsToHaveOwners(app); err != nil {
+			app.Logger().Error("failed to migrate pods to have owners", "reason", err)
+			return err
+		}
+
 		if err := initializePodServerManager(app, podman); err != nil {
 			app.Logger().Error("failed to inialize the pod server manager", "reason", err)
 		}
 
+		if err := resumePodProvisioning(app, podman); err != nil {
+			app.Logger().Error("failed to resume pod provisioning", "reason", err)
+		}
+
+		if err := failInterruptedMigrations(app); err != nil {
+			app.Logger().Error("failed to clean up interrupted pod migrations", "reason", err)
+		}
+
+		if err := failInterruptedHibernations(app); err != nil {
+			app.Logger().Error("failed to clean up interrupted pod hibernations", "reason", err)
+		}
+
+		go watchServerDrains(app, podman, sessions)
+		go runPodScheduler(app, podman)
+		go watchIdlePods(app, podman, sessions, idle)
+		go watchHibernatingPods(app, podman)
+		go watchPodUsage(app, podman, sessions)
+
+		if err := cleanupAllRecordings(app, recordings); err != nil {
+			app.Logger().Error("failed to cleanup session recordings", "reason", err)
+		}
+
 		return nil
 	})
 
 	app.OnRecordBeforeCreateRequest("classes").Add(makeClassesBeforeCreateRequest())
 	app.OnRecordBeforeUpdateRequest("classes").Add(makeClassesBeforeUpdateRequest())
+	app.OnRecordAfterUpdateRequest("classes").Add(makeClassesAfterUpdateRequest(app, podman))
 
 	app.OnRecordBeforeCreateRequest("users").Add(makeUsersBeforeCreateRequest())
+	app.OnRecordBeforeUpdateRequest("users").Add(makeUsersBeforeUpdateRequest())
+	app.OnRecordBeforeDeleteRequest("users").Add(makeUsersBeforeDeleteRequest(app))
+	app.OnRecordAfterDeleteRequest("users").Add(makeUsersAfterDeleteRequest(app, podman))
 
 	app.OnRecordBeforeCreateRequest("podServers").Add(makePodServersBeforeCreateRequest(podman))
-	app.OnRecordBeforeUpdateRequest("podServers").Add(makePodServersBeforeUpdateRequest(podman))
+	app.OnRecordBeforeUpdateRequest("podServers").Add(makePodServersBeforeUpdateRequest(app, podman, sessions))
 	app.OnRecordAfterDeleteRequest("podServers").Add(makePodServersAfterDeleteRequest(app, podman))
 
 	app.OnRecordBeforeCreateRequest("pods").Add(makePodsBeforeCreateRequest(app, podman))
 	app.OnRecordAfterCreateRequest("pods").Add(makePodsAfterCreateRequest(app, podman))
 	app.OnRecordBeforeUpdateRequest("pods").Add(makePodsBeforeUpdateRequest(app, podman))
 	app.OnRecordAfterDeleteRequest("pods").Add(makePodsAfterDeleteRequest(app, podman))
+	app.OnRecordAfterCreateRequest("pods").Add(makePodsAfterCreateRequestAudit(app))
+	app.OnRecordAfterUpdateRequest("pods").Add(makePodsAfterUpdateRequestAudit(app))
+	app.OnRecordAfterDeleteRequest("pods").Add(makePodsAfterDeleteRequestAudit(app))
+	app.OnFileDownloadRequest("pods").Add(makePodsFileDownloadRequest(app))
+
+	app.OnRecordBeforeCreateRequest("podSchedules").Add(makePodSchedulesBeforeCreateRequest())
+	app.OnRecordBeforeUpdateRequest("podSchedules").Add(makePodSchedulesBeforeUpdateRequest())
+
+	app.OnRecordBeforeCreateRequest("podSecrets").Add(makePodSecretsBeforeCreateRequest(app))
+	app.OnRecordBeforeUpdateRequest("podSecrets").Add(makePodSecretsBeforeUpdateRequest(app))
+	app.OnRecordAfterCreateRequest("podSecrets").Add(makePodSecretsAfterCreateRequest(app))
+	app.OnRecordAfterUpdateRequest("podSecrets").Add(makePodSecretsAfterUpdateRequest(app))
+	app.OnRecordAfterDeleteRequest("podSecrets").Add(makePodSecretsAfterDeleteRequest(app))
+	app.OnRecordViewRequest("podSecrets").Add(makePodSecretsViewRequest())
+	app.OnRecordsListRequest("podSecrets").Add(makePodSecretsListRequest())
+	app.OnRealtimeBeforeMessageSend().Add(makeRealtimeBeforeMessageSendHideSecrets())
 
 	app.OnRecordBeforeCreateRequest("pollAnswers").Add(makePollAnswersBeforeCreateRequest())
 
@@ -88,6 +190,10 @@ func initializePodServerManager(app *pocketbase.PocketBase, pm *pods.PodServerMa
 			// failed to connect, but keep going (as the server as added to the manager in this case)
 		}
 
+		if err := pm.SetServerMode(server.Id, server.GetString("mode")); err != nil {
+			return err
+		}
+
 		pods, err := app.Dao().FindRecordsByFilter(
 			"pods",
 			"server={:server}",
@@ -101,6 +207,10 @@ func initializePodServerManager(app *pocketbase.PocketBase, pm *pods.PodServerMa
 		}
 
 		for _, pod := range pods {
+			if pod.GetString("podId") == "" {
+				continue // not provisioned (yet)
+			}
+
 			if err := pm.AddExistingPodToServerWithoutConnect(server.Id, pod.GetString("podId")); err != nil {
 				return err
 			}
@@ -126,6 +236,13 @@ func checkAndMigrateUsersToHavePods(app *pocketbase.PocketBase) error {
 					return err
 				}
 			}
+
+			if maxSnapshots := user.GetInt("maxSnapshots"); maxSnapshots == 0 {
+				user.Set("maxSnapshots", defaultMaxSnapshots)
+				if err := txDao.SaveRecord(user); err != nil {
+					return err
+				}
+			}
 		}
 
 		return nil
@@ -176,6 +293,23 @@ func makeUsersBeforeCreateRequest() func(e *core.RecordCreateEvent) error {
 
 		e.Record.Set("role", "student")
 		e.Record.Set("maxPods", 1)
+		e.Record.Set("maxSnapshots", defaultMaxSnapshots)
+
+		return nil
+	}
+}
+
+func makeUsersBeforeUpdateRequest() func(e *core.RecordUpdateEvent) error {
+	return func(e *core.RecordUpdateEvent) error {
+		admin, _ := e.HttpContext.Get(apis.ContextAdminKey).(*models.Admin)
+		if admin != nil {
+			return nil // ignore for admins
+		}
+
+		// users would lift their own quotas
+		original := e.Record.OriginalCopy()
+		e.Record.Set("weeklyHours", original.GetFloat("weeklyHours"))
+		e.Record.Set("maxSnapshots", original.GetInt("maxSnapshots"))
 
 		return nil
 	}
@@ -185,7 +319,11 @@ func makeUsersBeforeCreateRequest() func(e *core.RecordCreateEvent) error {
 
 func makePodServersBeforeCreateRequest(pm *pods.PodServerManager) func(e *core.RecordCreateEvent) error {
 	return func(e *core.RecordCreateEvent) error {
-		return pm.Add(e.Record.Id, e.Record.GetString("address"))
+		if err := pm.Add(e.Record.Id, e.Record.GetString("address")); err != nil {
+			return err
+		}
+
+		return pm.SetServerMode(e.Record.Id, e.Record.GetString("mode"))
 	}
 }
 
@@ -199,113 +337,263 @@ func makePodServersAfterDeleteRequest(app *pocketbase.PocketBase, pm *pods.PodSe
 	}
 }
 
-func makePodServersBeforeUpdateRequest(pm *pods.PodServerManager) func(e *core.RecordUpdateEvent) error {
-	return func(e *core.RecordUpdateEvent) error {
-		return pm.Update(e.Record.Id, e.Record.GetString("address"))
-	}
-}
-
 // ============================================================================
 
 func makePodsBeforeCreateRequest(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(e *core.RecordCreateEvent) error {
 	return func(e *core.RecordCreateEvent) error {
 		info := apis.RequestInfo(e.HttpContext)
 
+		// class pods have their own quota, see ensureClassPod
 		maxPods := info.AuthRecord.GetInt("maxPods")
-		pods := info.AuthRecord.GetStringSlice("pods")
-		if len(pods)+1 > maxPods {
+		pods, err := countPersonalPods(app, info.AuthRecord)
+		if err != nil {
+			return err
+		}
+
+		if pods+1 > maxPods {
 			return apis.NewForbiddenError("already reached limit of pods for account", map[string]any{
 				"maxPods": maxPods,
-				"pods":    len(pods),
+				"pods":    pods,
 			})
 		}
 
-		serverId := e.Record.GetString("server")
-		podName := e.Record.GetString("name")
-		podImage := e.Record.GetString("image")
+		// only set for the pods provisioned by a class
+		e.Record.Set("student", "")
+		e.Record.Set("owner", info.AuthRecord.Id)
 
-		podId, err := pm.AddNewPodToServer(serverId, podName, podImage)
-		if err != nil {
+		if err := checkServerTakesPods(app, e.Record.GetString("server")); err != nil {
 			return err
 		}
 
-		e.Record.Set("podId", podId)
+		if classId := e.Record.GetString("class"); classId != "" {
+			canLink, err := canLinkPodToClass(app, info.AuthRecord, classId)
+			if err != nil {
+				return apis.NewBadRequestError("invalid class", err)
+			}
 
-		data, err := pm.InspectPodById(podId)
-		if err != nil {
-			app.Logger().Error("failed to inspect pod after create", "podId", podId, "reason", err)
-		} else {
-			e.Record.Set("running", data.State.Running)
-			e.Record.Set("status", data.State.Status)
+			if !canLink {
+				return apis.NewForbiddenError("can't link a pod to that class", nil)
+			}
 		}
 
-		return nil
-	}
-}
+		if templateId := e.Record.GetString("template"); templateId != "" {
+			template, err := app.Dao().FindRecordById("podTemplates", templateId)
+			if err != nil {
+				return apis.NewBadRequestError("invalid template", err)
+			}
 
-func makePodsAfterCreateRequest(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(e *core.RecordCreateEvent) error {
-	return func(e *core.RecordCreateEvent) error {
-		info := apis.RequestInfo(e.HttpContext)
+			canUse, err := canUseTemplate(app, info.AuthRecord, template)
+			if err != nil {
+				return err
+			}
 
-		if err := app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
-			user, err := txDao.FindRecordById("users", info.AuthRecord.Id)
+			if !canUse {
+				return apis.NewForbiddenError("template is not available for account", nil)
+			}
+
+			spec, err := podSpecFromTemplate(template)
 			if err != nil {
 				return err
 			}
 
-			pods := user.GetStringSlice("pods")
-			pods = append(pods, e.Record.Id)
-			user.Set("pods", pods)
-
-			app.Logger().Info(
-				"added a pod to user",
-				"user",
-				info.AuthRecord.Id,
-				"pod",
-				e.Record.Id,
-				"pods",
-				pods,
-			)
-
-			return txDao.SaveRecord(user)
-		}); err != nil {
+			e.Record.Set("image", spec.Image)
+		} else if info.AuthRecord.GetString("role") == "editor" {
+			// editors may still try out any image
+			if e.Record.GetString("image") == "" {
+				return apis.NewBadRequestError("missing image", nil)
+			}
+		} else {
+			return apis.NewBadRequestError("pods must be created from a template", nil)
+		}
+
+		if err := validatePodEnv(e.Record); err != nil {
 			return err
 		}
 
+		volume, err := resolvePodVolume(app, info.AuthRecord, e.Record.GetString("volume"))
+		if err != nil {
+			return err
+		}
+
+		// the container is created once the record exists, see provisionPod
+		e.Record.Set("podId", "")
+		e.Record.Set("volume", volume)
+		e.Record.Set("state", podStateProvisioning)
+		e.Record.Set("provisionError", "")
+
+		// only written by the control plane
+		e.Record.Set("exitHistory", nil)
+		e.Record.Set("crashLoop", false)
+		e.Record.Set("migrationStatus", "")
+		e.Record.Set("migrationStep", "")
+		e.Record.Set("migrationError", "")
+		e.Record.Set("hibernatedImage", "")
+		e.Record.Set("hibernationArchive", "")
+		delete(e.UploadedFiles, "hibernationArchive")
+
+		return nil
+	}
+}
+
+func makePodsAfterCreateRequest(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(e *core.RecordCreateEvent) error {
+	return func(e *core.RecordCreateEvent) error {
+		provisionPodLater(app, pm, e.Record.Id)
+
 		return nil
 	}
 }
 
 func makePodsAfterDeleteRequest(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(e *core.RecordDeleteEvent) error {
 	return func(e *core.RecordDeleteEvent) error {
-		serverId := e.Record.GetString("server")
-		podId := e.Record.GetString("podId")
+		cleanupDeletedPod(app, pm, e.Record)
 
+		return nil
+	}
+}
+
+// Removes everything a deleted pod had on its pod server.
+func cleanupDeletedPod(app *pocketbase.PocketBase, pm *pods.PodServerManager, pod *models.Record) {
+	serverId := pod.GetString("server")
+	podId := pod.GetString("podId")
+
+	// pods that are still provisioning have no container yet, provisionPod
+	// removes it once it finds the pod gone
+	if podId != "" {
 		err := pm.DeletePodFromServer(serverId, podId, defaultDeleteTimeout)
 		if err != nil {
-			app.Logger().Error("failed to delete pod", "podServer", serverId, "pod", e.Record.Id, "reason", err)
+			app.Logger().Error("failed to delete pod", "podServer", serverId, "pod", pod.Id, "reason", err)
 		}
+	}
 
-		return nil
+	deletePodSnapshots(app, pm, serverId, pod.Id)
+
+	// hibernated pods took their volume with them into the archive
+	volume := pod.GetString("volume")
+	if volume != "" && !pod.GetBool("keepVolume") && pod.GetString("state") != podStateHibernated {
+		if err := pm.DeleteVolumeFromServer(serverId, volume); err != nil {
+			app.Logger().Error("failed to delete pod volume", "podServer", serverId, "pod", pod.Id, "volume", volume, "reason", err)
+		}
+	}
+}
+
+// Removes a pod from a server along with its volume, when it has one. The
+// volume is left alone when the container couldn't be removed, it would
+// still be in use. Failures are only logged, callers have nothing left to
+// roll back.
+func deletePodAndVolumeFromServer(app *pocketbase.PocketBase, pm *pods.PodServerManager, serverId, podId, volume string) {
+	if podId != "" {
+		if err := pm.DeletePodFromServer(serverId, podId, defaultDeleteTimeout); err != nil {
+			app.Logger().Error("failed to delete pod", "podServer", serverId, "pod", podId, "reason", err)
+			return
+		}
+	}
+
+	if volume != "" {
+		if err := pm.DeleteVolumeFromServer(serverId, volume); err != nil {
+			app.Logger().Error("failed to delete pod volume", "podServer", serverId, "volume", volume, "reason", err)
+		}
 	}
 }
 
 func makePodsBeforeUpdateRequest(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(e *core.RecordUpdateEvent) error {
 	return func(e *core.RecordUpdateEvent) error {
+		original := e.Record.OriginalCopy()
+
 		serverId := e.Record.GetString("server")
-		podId := e.Record.GetString("podId")
+		podId := original.GetString("podId")
+		if original.GetString("state") == podStateHibernated {
+			return apis.NewBadRequestError("", errPodHibernated)
+		}
+
+		if podId == "" {
+			return apis.NewBadRequestError("", errPodNotProvisioned)
+		}
+
+		if err := checkPodNotMigrating(original); err != nil {
+			return apis.NewBadRequestError("", err)
+		}
+
+		// moving a pod takes more than pointing the record somewhere else
+		if serverId != original.GetString("server") {
+			return apis.NewBadRequestError("pods can only change servers through a migration", nil)
+		}
 
 		err := pm.AddExistingPodToServer(serverId, podId)
 		if err != nil {
 			return err
 		}
 
+		admin, _ := e.HttpContext.Get(apis.ContextAdminKey).(*models.Admin)
+
+		classId := e.Record.GetString("class")
+		if admin == nil && classId != "" && classId != original.GetString("class") {
+			info := apis.RequestInfo(e.HttpContext)
+
+			canLink, err := canLinkPodToClass(app, info.AuthRecord, classId)
+			if err != nil {
+				return apis.NewBadRequestError("invalid class", err)
+			}
+
+			if !canLink {
+				return apis.NewForbiddenError("can't link a pod to that class", nil)
+			}
+		}
+
+		if admin == nil {
+			// only written by the control plane
+			e.Record.Set("exitHistory", original.Get("exitHistory"))
+			e.Record.Set("crashLoop", original.GetBool("crashLoop"))
+			e.Record.Set("podId", podId)
+			e.Record.Set("state", original.GetString("state"))
+			e.Record.Set("provisionError", original.GetString("provisionError"))
+			e.Record.Set("migrationStatus", original.GetString("migrationStatus"))
+			e.Record.Set("migrationStep", original.GetString("migrationStep"))
+			e.Record.Set("migrationError", original.GetString("migrationError"))
+			e.Record.Set("hibernatedImage", original.GetString("hibernatedImage"))
+			e.Record.Set("hibernationArchive", original.GetString("hibernationArchive"))
+			delete(e.UploadedFiles, "hibernationArchive")
+			e.Record.Set("student", original.GetString("student"))
+			e.Record.Set("owner", original.GetString("owner"))
+			// the container is created again from these on migrations, wakes and
+			// restores, and the volume is deleted along with the pod
+			e.Record.Set("template", original.GetString("template"))
+			e.Record.Set("image", original.GetString("image"))
+			e.Record.Set("volume", original.GetString("volume"))
+			e.Record.Set("keepVolume", original.GetBool("keepVolume"))
+			// the owner is the one being recorded, so only editors decide
+			info := apis.RequestInfo(e.HttpContext)
+			if info.AuthRecord == nil || info.AuthRecord.GetString("role") != "editor" {
+				e.Record.Set("recordSessions", original.GetBool("recordSessions"))
+			}
+
+			if original.GetString("student") != "" {
+				// class pods stay with their class
+				e.Record.Set("class", original.GetString("class"))
+			}
+		}
+
+		// only applied when the container is created again
+		if err := validatePodEnv(e.Record); err != nil {
+			return err
+		}
+
+		policyChanged := original.GetString("restartPolicy") != e.Record.GetString("restartPolicy") ||
+			original.GetInt("restartMaxRetries") != e.Record.GetInt("restartMaxRetries")
+
+		// a pod in a crash loop gets its policy back when started again
+		if policyChanged && !e.Record.GetBool("crashLoop") {
+			if err := pm.SetPodRestartPolicyById(podId, *podRestartPolicy(e.Record)); err != nil {
+				return err
+			}
+		}
+
 		data, err := pm.InspectPodById(podId)
 		if err != nil {
 			app.Logger().Error("failed to inspect pod during update", "podId", podId, "reason", err)
 		} else {
-			e.Record.Set("running", data.State.Running)
-			e.Record.Set("status", data.State.Status)
+			for k, v := range podInspectFields(data) {
+				e.Record.Set(k, v)
+			}
 		}
 
 		return nil
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"noroom/pb/pods"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// How often draining servers are checked for a passed deadline.
+const drainCheckInterval = time.Second * 30
+
+type remainingPod struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+}
+
+func makePodServersBeforeUpdateRequest(app *pocketbase.PocketBase, pm *pods.PodServerManager, sm *pods.SessionManager) func(e *core.RecordUpdateEvent) error {
+	return func(e *core.RecordUpdateEvent) error {
+		original := e.Record.OriginalCopy()
+
+		// reconnecting drops the state of every pod, so only do it when needed
+		if original.GetString("address") != e.Record.GetString("address") {
+			if err := pm.Update(e.Record.Id, e.Record.GetString("address")); err != nil {
+				return err
+			}
+		}
+
+		mode := e.Record.GetString("mode")
+		if err := pm.SetServerMode(e.Record.Id, mode); err != nil {
+			return apis.NewBadRequestError("", err)
+		}
+
+		if mode != original.GetString("mode") {
+			notifyServerMode(app, sm, e.Record)
+		}
+
+		return nil
+	}
+}
+
+// Lists the pods still on a server, so editors know when a draining server is
+// empty.
+func makeApiNoroomPodServerRemaining(app *pocketbase.PocketBase) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		if info.AuthRecord.GetString("role") != "editor" {
+			return apis.NewForbiddenError("", nil)
+		}
+
+		server, err := app.Dao().FindRecordById("podServers", id)
+		if err != nil {
+			return err
+		}
+
+		serverPods, err := findPodsOnServer(app, server.Id)
+		if err != nil {
+			return err
+		}
+
+		remaining := make([]remainingPod, 0, len(serverPods))
+		for _, pod := range serverPods {
+			remaining = append(remaining, remainingPod{
+				Id:      pod.Id,
+				Name:    pod.GetString("name"),
+				Running: pod.GetBool("running"),
+			})
+		}
+
+		return c.JSON(http.StatusOK, map[string]any{
+			"mode":      server.GetString("mode"),
+			"deadline":  server.GetDateTime("drainDeadline"),
+			"remaining": remaining,
+		})
+	}
+}
+
+// Tells everyone attached to a pod on the server that it is going away.
+func notifyServerMode(app *pocketbase.PocketBase, sm *pods.SessionManager, server *models.Record) {
+	var notice string
+	switch server.GetString("mode") {
+	case pods.ServerModeDraining:
+		notice = "this pod server is going into maintenance, move your work elsewhere"
+		if deadline := server.GetDateTime("drainDeadline"); !deadline.IsZero() {
+			notice += fmt.Sprintf(", pods will be stopped at %s", deadline.Time().Local().Format(time.DateTime))
+		}
+	case pods.ServerModeMaintenance:
+		notice = "this pod server is now in maintenance"
+	default:
+		return
+	}
+
+	serverPods, err := findPodsOnServer(app, server.Id)
+	if err != nil {
+		app.Logger().Error("failed to find pods to notify", "podServer", server.Id, "reason", err)
+		return
+	}
+
+	for _, pod := range serverPods {
+		if podId := pod.GetString("podId"); podId != "" {
+			sm.Notify(podId, notice)
+		}
+	}
+}
+
+func watchServerDrains(app *pocketbase.PocketBase, pm *pods.PodServerManager, sm *pods.SessionManager) {
+	for range time.Tick(drainCheckInterval) {
+		if err := finishServerDrains(app, pm, sm); err != nil {
+			app.Logger().Error("failed to check draining pod servers", "reason", err)
+		}
+	}
+}
+
+// Draining servers whose deadline passed go into maintenance, stopping their
+// pods first if asked to.
+func finishServerDrains(app *pocketbase.PocketBase, pm *pods.PodServerManager, sm *pods.SessionManager) error {
+	draining, err := app.Dao().FindRecordsByFilter(
+		"podServers",
+		"mode={:mode} && drainDeadline!='' && drainDeadline<={:now}",
+		"",
+		0,
+		0,
+		dbx.Params{"mode": pods.ServerModeDraining, "now": types.NowDateTime()},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, server := range draining {
+		if server.GetBool("drainStopPods") {
+			stopPodsOnServer(app, pm, server.Id)
+		}
+
+		// stopping the pods takes a while, only the mode is written so the
+		// health of the server is kept, and an editor that made the server
+		// active again meanwhile wins
+		result, err := app.Dao().DB().
+			Update(
+				"podServers",
+				dbx.Params{"mode": pods.ServerModeMaintenance, "updated": types.NowDateTime()},
+				dbx.HashExp{"id": server.Id, "mode": pods.ServerModeDraining},
+			).
+			Execute()
+		if err != nil {
+			return err
+		}
+
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if updated == 0 {
+			continue
+		}
+
+		server.Set("mode", pods.ServerModeMaintenance)
+
+		if err := pm.SetServerMode(server.Id, pods.ServerModeMaintenance); err != nil {
+			return err
+		}
+
+		notifyServerMode(app, sm, server)
+	}
+
+	return nil
+}
+
+func stopPodsOnServer(app *pocketbase.PocketBase, pm *pods.PodServerManager, serverId string) {
+	serverPods, err := findPodsOnServer(app, serverId)
+	if err != nil {
+		app.Logger().Error("failed to find pods to stop", "podServer", serverId, "reason", err)
+		return
+	}
+
+	for _, pod := range serverPods {
+		podId := pod.GetString("podId")
+		if podId == "" || !pod.GetBool("running") {
+			continue
+		}
+
+		if err := pm.StopPodById(podId, defaultStartTimeout); err != nil {
+			app.Logger().Error("failed to stop pod for maintenance", "podServer", serverId, "pod", pod.Id, "reason", err)
+			continue
+		}
+
+		getAndUpdatePodInspectDataLater(app, pm, pod.Id)
+	}
+}
+
+func findPodsOnServer(app *pocketbase.PocketBase, serverId string) ([]*models.Record, error) {
+	return app.Dao().FindRecordsByFilter(
+		"pods",
+		"server={:server}",
+		"",
+		0,
+		0,
+		dbx.Params{"server": serverId},
+	)
+}
+
+// Pods are only created on active servers. The manager checks this as well,
+// but provisioning happens later, so fail the request early.
+func checkServerTakesPods(app *pocketbase.PocketBase, serverId string) error {
+	server, err := app.Dao().FindRecordById("podServers", serverId)
+	if err != nil {
+		return apis.NewBadRequestError("invalid server", err)
+	}
+
+	switch server.GetString("mode") {
+	case pods.ServerModeDraining:
+		return apis.NewBadRequestError("", pods.ErrServerDraining)
+	case pods.ServerModeMaintenance:
+		return apis.NewBadRequestError("", pods.ErrServerInMaintenance)
+	default:
+		return nil
+	}
+}
+
+// Picks the server for a pod nobody chose a server for: the active server
+// that is not known to be offline and has the fewest pods.
+func pickPodServer(app *pocketbase.PocketBase) (string, error) {
+	servers, err := app.Dao().FindRecordsByFilter(
+		"podServers",
+		"(mode='' || mode={:active}) && status!={:offline}",
+		"",
+		0,
+		0,
+		dbx.Params{"active": pods.ServerModeActive, "offline": pods.ServerStatusOffline},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	best := ""
+	bestCount := 0
+	for _, server := range servers {
+		var count int
+		if err := app.Dao().DB().
+			Select("count(*)").
+			From("pods").
+			Where(dbx.HashExp{"server": server.Id}).
+			Row(&count); err != nil {
+			return "", err
+		}
+
+		if best == "" || count < bestCount {
+			best = server.Id
+			bestCount = count
+		}
+	}
+
+	if best == "" {
+		return "", errors.New("no pod server is available")
+	}
+
+	return best, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"noroom/pb/pods"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+const (
+	migrationRunning = "running"
+	migrationDone    = "done"
+	migrationFailed  = "failed"
+)
+
+// Anything that starts, replaces or snapshots the container of a pod waits
+// for its migration to end. The old container is stopped and then deleted
+// by the migration, whatever happens to it meanwhile is lost.
+var errPodMigrating = errors.New("pod is being migrated")
+
+func checkPodNotMigrating(pod *models.Record) error {
+	if pod.GetString("migrationStatus") == migrationRunning {
+		return errPodMigrating
+	}
+
+	return nil
+}
+
+const (
+	defaultMigrateStopTimeout = time.Second * 20
+	migrateSnapshotTag        = "migrated"
+)
+
+// Moves a pod to another pod server, so a server can be emptied before
+// maintenance. Only editors can migrate pods. The migration runs in the
+// background, its progress is kept on the pod record.
+func makeApiNoroomPodMigrate(app *pocketbase.PocketBase, pm *pods.PodServerManager, validate *validator.Validate) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		type bodyModel struct {
+			Server string `json:"server" validate:"required"`
+		}
+
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		var body bodyModel
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+
+		if err := validate.Struct(body); err != nil {
+			return err
+		}
+
+		if info.AuthRecord.GetString("role") != "editor" {
+			return apis.NewForbiddenError("only editors can migrate pods", nil)
+		}
+
+		pod, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		if pod.GetString("podId") == "" {
+			return apis.NewBadRequestError("", errPodNotProvisioned)
+		}
+
+		if pod.GetString("migrationStatus") == migrationRunning {
+			return apis.NewBadRequestError("pod is already being migrated", nil)
+		}
+
+		if pod.GetString("server") == body.Server {
+			return apis.NewBadRequestError("pod is already on that server", nil)
+		}
+
+		if err := checkServerTakesPods(app, body.Server); err != nil {
+			return err
+		}
+
+		pod.Set("migrationStatus", migrationRunning)
+		pod.Set("migrationStep", "queued")
+		pod.Set("migrationError", "")
+		if err := app.Dao().SaveRecord(pod); err != nil {
+			return err
+		}
+
+		go func() {
+			if err := migratePod(app, pm, pod, body.Server); err != nil {
+				app.Logger().Error("failed to migrate pod", "pod", pod.Id, "server", body.Server, "reason", err)
+			}
+		}()
+
+		return c.NoContent(http.StatusAccepted)
+	}
+}
+
+// Stops the pod, snapshots it (home volume included) and moves the snapshot
+// to the target server, where the container is created again from it. This
+// is the same path hibernation takes, so nothing the pod wrote is lost, even
+// outside its volume. Nothing is removed from the source server until the
+// record points to the new container, and whatever was done on the target
+// server is undone when a step fails.
+//
+// Snapshots are images local to a server, so they are not migrated. They are
+// removed from the source server along with the rest of the pod.
+func migratePod(app *pocketbase.PocketBase, pm *pods.PodServerManager, pod *models.Record, target string) error {
+	source := pod.GetString("server")
+	oldPodId := pod.GetString("podId")
+	wasRunning := pod.GetBool("running")
+
+	var (
+		image    string
+		imported bool
+		newPodId string
+	)
+
+	rollback := func(cause error) error {
+		if imported {
+			deletePodAndVolumeFromServer(app, pm, target, newPodId, pod.GetString("volume"))
+
+			if err := pm.DeleteSnapshotFromServer(target, image); err != nil {
+				app.Logger().Error("failed to delete migration snapshot", "podServer", target, "pod", pod.Id, "reason", err)
+			}
+		}
+
+		if image != "" {
+			if err := pm.DeleteSnapshotFromServer(source, image); err != nil {
+				app.Logger().Error("failed to delete migration snapshot", "podServer", source, "pod", pod.Id, "reason", err)
+			}
+		}
+
+		if wasRunning {
+			if err := pm.StartPodById(oldPodId, defaultStartTimeout); err != nil {
+				app.Logger().Error("failed to start pod again after migration", "pod", pod.Id, "reason", err)
+			}
+		}
+
+		return errors.Join(cause, setPodMigration(app, pod.Id, migrationFailed, "", cause.Error()))
+	}
+
+	step := func(name string) {
+		if err := setPodMigration(app, pod.Id, migrationRunning, name, ""); err != nil {
+			app.Logger().Error("failed to save migration progress", "pod", pod.Id, "reason", err)
+		}
+	}
+
+	step("stopping")
+	if err := pm.StopPodById(oldPodId, defaultMigrateStopTimeout); err != nil {
+		return rollback(fmt.Errorf("failed to stop pod: %w", err))
+	}
+
+	step("snapshotting")
+	image, err := pm.SnapshotPodById(oldPodId, pod.Id, migrateSnapshotTag, defaultSnapshotTimeout)
+	if err != nil {
+		return rollback(fmt.Errorf("failed to snapshot pod: %w", err))
+	}
+
+	step("copying snapshot")
+	if err := copySnapshotBetweenServers(pm, source, target, image); err != nil {
+		return rollback(fmt.Errorf("failed to copy snapshot: %w", err))
+	}
+
+	imported = true
+
+	step("creating")
+	// read again, settings may have changed while the snapshot was copied
+	current, err := app.Dao().FindRecordById("pods", pod.Id)
+	if err != nil {
+		return rollback(err)
+	}
+
+	spec, err := podSpecFromRecord(app, current)
+	if err != nil {
+		return rollback(err)
+	}
+
+	// the snapshot has everything the pod had, files included. Its volume is
+	// created empty on the target, so docker fills it from the snapshot.
+	spec.Image = image
+	spec.Files = nil
+
+	newPodId, err = pm.AddNewPodToServer(target, spec)
+	if err != nil {
+		return rollback(fmt.Errorf("failed to create pod: %w", err))
+	}
+
+	if wasRunning {
+		step("starting")
+		if err := pm.StartPodById(newPodId, defaultStartTimeout); err != nil {
+			return rollback(fmt.Errorf("failed to start pod: %w", err))
+		}
+	}
+
+	step("switching")
+	current.Set("server", target)
+	current.Set("podId", newPodId)
+	current.Set("migrationStatus", migrationDone)
+	current.Set("migrationStep", "")
+	current.Set("migrationError", "")
+	if err := app.Dao().SaveRecord(current); err != nil {
+		return rollback(fmt.Errorf("failed to switch pod: %w", err))
+	}
+
+	// from here on the pod lives on the target, failures only leave garbage.
+	// The migration snapshot goes away with the other snapshots of the pod.
+	deletePodAndVolumeFromServer(app, pm, source, oldPodId, pod.GetString("volume"))
+	deletePodSnapshots(app, pm, source, pod.Id)
+
+	getAndUpdatePodInspectDataLater(app, pm, pod.Id)
+
+	return nil
+}
+
+func copySnapshotBetweenServers(pm *pods.PodServerManager, source, target, image string) error {
+	archive, err := pm.ExportSnapshotFromServer(source, image)
+	if err != nil {
+		return err
+	}
+
+	defer archive.Close()
+
+	return pm.ImportSnapshotToServer(target, archive)
+}
+
+func setPodMigration(app *pocketbase.PocketBase, id, status, step, reason string) error {
+	pod, err := app.Dao().FindRecordById("pods", id)
+	if err != nil {
+		return err
+	}
+
+	pod.Set("migrationStatus", status)
+	pod.Set("migrationStep", step)
+	pod.Set("migrationError", reason)
+
+	return app.Dao().SaveRecord(pod)
+}
+
+// Migrations don't survive a restart. The pod stays on its source server, but
+// may have been left stopped, and the target server may hold a copy of it.
+func failInterruptedMigrations(app *pocketbase.PocketBase) error {
+	interrupted, err := app.Dao().FindRecordsByFilter(
+		"pods",
+		"migrationStatus={:status}",
+		"",
+		0,
+		0,
+		dbx.Params{"status": migrationRunning},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range interrupted {
+		app.Logger().Warn("pod migration was interrupted", "pod", pod.Id, "step", pod.GetString("migrationStep"))
+
+		if err := setPodMigration(app, pod.Id, migrationFailed, "", "interrupted by a restart"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
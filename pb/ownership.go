@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"noroom/pb/pods"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// Pods used to belong to whoever had them in `users.pods`. The array is no
+// longer written, the owner of the pod is the only source of truth.
+func checkAndMigratePodsToHaveOwners(app *pocketbase.PocketBase) error {
+	return app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		unowned, err := txDao.FindRecordsByFilter("pods", "owner=''", "", 0, 0)
+		if err != nil {
+			return err
+		}
+
+		for _, pod := range unowned {
+			owner := pod.GetString("student")
+			if owner == "" {
+				user, err := txDao.FindFirstRecordByFilter("users", "pods~{:pod}", dbx.Params{"pod": pod.Id})
+				if errors.Is(err, sql.ErrNoRows) {
+					app.Logger().Warn("pod has no owner to migrate to", "pod", pod.Id)
+					continue
+				} else if err != nil {
+					return err
+				}
+
+				owner = user.Id
+			}
+
+			pod.Set("owner", owner)
+			if err := txDao.SaveRecord(pod); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Hands a pod over to another user. Only editors can do this. Class pods stay
+// with their student.
+func makeApiNoroomPodTransfer(app *pocketbase.PocketBase, validate *validator.Validate) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		type bodyModel struct {
+			User string `json:"user" validate:"required"`
+		}
+
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		var body bodyModel
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+
+		if err := validate.Struct(body); err != nil {
+			return err
+		}
+
+		if info.AuthRecord.GetString("role") != "editor" {
+			return apis.NewForbiddenError("only editors can transfer pods", nil)
+		}
+
+		pod, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		if pod.GetString("student") != "" {
+			return apis.NewBadRequestError("class pods can't be transferred", nil)
+		}
+
+		if pod.GetString("owner") == body.User {
+			return apis.NewBadRequestError("pod already belongs to that user", nil)
+		}
+
+		if _, err := app.Dao().FindRecordById("users", body.User); err != nil {
+			return apis.NewBadRequestError("invalid user", err)
+		}
+
+		if err := transferPod(app, pod.Id, body.User); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// The new owner stops being a collaborator of the pod, if they were one. The
+// home volume keeps its name, which would give it back to the old owner if
+// it outlived the pod, so it is no longer kept.
+func transferPod(app *pocketbase.PocketBase, podRecordId, userId string) error {
+	return app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		pod, err := txDao.FindRecordById("pods", podRecordId)
+		if err != nil {
+			return err
+		}
+
+		collaborator, err := txDao.FindFirstRecordByFilter(
+			"podCollaborators",
+			"pod={:pod} && user={:user}",
+			dbx.Params{"pod": pod.Id, "user": userId},
+		)
+		if err == nil {
+			if err := txDao.DeleteRecord(collaborator); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		pod.Set("owner", userId)
+		pod.Set("keepVolume", false)
+
+		return txDao.SaveRecord(pod)
+	})
+}
+
+// Where the pods of a user being deleted are kept until the user is gone.
+// Deleting the user clears the owner of its pods, so they can't be found
+// afterwards.
+const contextDeletedUserPodsKey = "noroomDeletedUserPods"
+
+// The pods of a deleted user are deleted along with their containers, unless
+// an admin asks for them to be handed to someone else with
+// `?transferPodsTo=<user id>`. Class pods of the user are always deleted.
+//
+// Nothing happens to the pods here, they are only looked up. They are deleted
+// or transferred once the user is, see makeUsersAfterDeleteRequest.
+func makeUsersBeforeDeleteRequest(app *pocketbase.PocketBase) func(e *core.RecordDeleteEvent) error {
+	return func(e *core.RecordDeleteEvent) error {
+		transferTo := e.HttpContext.QueryParam("transferPodsTo")
+		if transferTo != "" {
+			if transferTo == e.Record.Id {
+				return apis.NewBadRequestError("can't transfer pods to the user being deleted", nil)
+			}
+
+			if _, err := app.Dao().FindRecordById("users", transferTo); err != nil {
+				return apis.NewBadRequestError("invalid user to transfer pods to", err)
+			}
+		}
+
+		owned, err := app.Dao().FindRecordsByFilter(
+			"pods",
+			"owner={:user}",
+			"",
+			0,
+			0,
+			dbx.Params{"user": e.Record.Id},
+		)
+		if err != nil {
+			return err
+		}
+
+		e.HttpContext.Set(contextDeletedUserPodsKey, owned)
+
+		return nil
+	}
+}
+
+// The user is already gone, so a pod that fails to be deleted or transferred
+// doesn't stop the others. Failures are in the audit log of the pod.
+func makeUsersAfterDeleteRequest(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(e *core.RecordDeleteEvent) error {
+	return func(e *core.RecordDeleteEvent) error {
+		owned, _ := e.HttpContext.Get(contextDeletedUserPodsKey).([]*models.Record)
+		transferTo := e.HttpContext.QueryParam("transferPodsTo")
+
+		for _, pod := range owned {
+			entry := podAuditEntry{
+				pod:  pod.Id,
+				name: pod.GetString("name"),
+				time: time.Now(),
+				c:    e.HttpContext,
+			}
+
+			if transferTo != "" && pod.GetString("student") == "" {
+				entry.action = "transfer"
+				entry.params = map[string]any{"from": e.Record.Id, "user": transferTo}
+				entry.err = transferPod(app, pod.Id, transferTo)
+
+				auditPod(app, entry)
+				if entry.err != nil {
+					app.Logger().Error("failed to transfer pod of deleted user", "pod", pod.Id, "user", transferTo, "reason", entry.err)
+				}
+
+				continue
+			}
+
+			entry.action = "delete"
+			entry.params = map[string]any{"reason": "owner deleted", "owner": e.Record.Id}
+			entry.err = app.Dao().DeleteRecord(pod)
+
+			auditPod(app, entry)
+			if entry.err != nil {
+				app.Logger().Error("failed to delete pod of deleted user", "pod", pod.Id, "reason", entry.err)
+				continue
+			}
+
+			cleanupDeletedPod(app, pm, pod)
+		}
+
+		return nil
+	}
+}
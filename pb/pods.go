@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"noroom/pb/pods"
 	"noroom/rpc"
 	"time"
 
+	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v5"
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/apis"
@@ -33,9 +36,8 @@ func makeApiNoroomPodStart(app *pocketbase.PocketBase, pm *pods.PodServerManager
 			return err
 		}
 
-		canAccess, err := app.Dao().CanAccessRecord(pod, info, pod.Collection().UpdateRule)
-		if !canAccess {
-			return apis.NewForbiddenError("", err)
+		if err := requirePodRole(app, info, pod, podRoleOperator); err != nil {
+			return err
 		}
 
 		timeout := defaultStartTimeout
@@ -46,6 +48,29 @@ func makeApiNoroomPodStart(app *pocketbase.PocketBase, pm *pods.PodServerManager
 			}
 		}
 
+		if err := checkPodNotMigrating(pod); err != nil {
+			return apis.NewBadRequestError("", err)
+		}
+
+		if err := checkPodQuota(app, pod, time.Now()); errors.Is(err, errUsageQuotaExceeded) {
+			return apis.NewForbiddenError(err.Error(), nil)
+		} else if err != nil {
+			return err
+		}
+
+		// waking up takes a while, the pod is started once it is back
+		switch pod.GetString("state") {
+		case podStateHibernated:
+			wakePodLater(app, pm, id)
+			return c.NoContent(http.StatusAccepted)
+		case podStateWaking:
+			return c.NoContent(http.StatusAccepted)
+		}
+
+		if err := resetPodCrashLoop(app, pm, pod); err != nil {
+			return err
+		}
+
 		podId := pod.GetString("podId")
 		if err := pm.StartPodById(podId, timeout); err != nil {
 			return err
@@ -71,9 +96,8 @@ func makeApiNoroomPodStop(app *pocketbase.PocketBase, pm *pods.PodServerManager)
 			return err
 		}
 
-		canAccess, err := app.Dao().CanAccessRecord(pod, info, pod.Collection().UpdateRule)
-		if !canAccess {
-			return apis.NewForbiddenError("", err)
+		if err := requirePodRole(app, info, pod, podRoleOperator); err != nil {
+			return err
 		}
 
 		timeout := defaultStartTimeout
@@ -109,9 +133,8 @@ func makeApiNoroomPodKill(app *pocketbase.PocketBase, pm *pods.PodServerManager)
 			return err
 		}
 
-		canAccess, err := app.Dao().CanAccessRecord(pod, info, pod.Collection().UpdateRule)
-		if !canAccess {
-			return apis.NewForbiddenError("", err)
+		if err := requirePodRole(app, info, pod, podRoleOperator); err != nil {
+			return err
 		}
 
 		timeout := defaultStartTimeout
@@ -147,9 +170,8 @@ func makeApiNoroomPodInspect(app *pocketbase.PocketBase, pm *pods.PodServerManag
 			return err
 		}
 
-		canAccess, err := app.Dao().CanAccessRecord(pod, info, pod.Collection().ViewRule)
-		if !canAccess {
-			return apis.NewForbiddenError("", err)
+		if err := requirePodRole(app, info, pod, podRoleViewer); err != nil {
+			return err
 		}
 
 		podId := pod.GetString("podId")
@@ -166,7 +188,9 @@ func makeApiNoroomPodInspect(app *pocketbase.PocketBase, pm *pods.PodServerManag
 	}
 }
 
-func makeApiNoroomPodAttach(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(c echo.Context) error {
+// Owners and operators attach read-write, unless they ask for
+// `?readonly=true`. Viewers always attach read-only.
+func makeApiNoroomPodAttach(app *pocketbase.PocketBase, sm *pods.SessionManager, idle *idleTracker) func(c echo.Context) error {
 	return func(c echo.Context) error {
 		info := apis.RequestInfo(c)
 
@@ -180,41 +204,62 @@ func makeApiNoroomPodAttach(app *pocketbase.PocketBase, pm *pods.PodServerManage
 			return err
 		}
 
-		canAccess, err := app.Dao().CanAccessRecord(pod, info, pod.Collection().UpdateRule)
-		if !canAccess {
-			return apis.NewForbiddenError("", err)
-		}
-
-		podId := pod.GetString("podId")
-		stream, err := pm.AttachPodById(podId)
+		role, err := podRoleOf(app, info, pod)
 		if err != nil {
 			return err
 		}
 
+		if role < podRoleViewer {
+			return apis.NewForbiddenError("", nil)
+		}
+
+		if err := checkPodNotMigrating(pod); err != nil {
+			return apis.NewBadRequestError("", err)
+		}
+
+		readOnly := c.QueryParam("readonly") == "true" || role < podRoleOperator
+
+		name := info.AuthRecord.GetString("name")
+		if name == "" {
+			name = info.AuthRecord.Username()
+		}
+
+		podId := pod.GetString("podId")
 		l := app.Logger()
 
+		// only joined once the handshake is done, otherwise nothing would
+		// ever leave the session
 		websocket.Handler(func(ws *websocket.Conn) {
 			defer ws.Close()
-			defer stream.Close()
+
+			viewer, err := sm.Join(podId, name, readOnly)
+			if err != nil {
+				l.Error("failed to join pod session", "reason", err, "podId", podId)
+				websocket.Message.Send(ws, formatTerminalNotice("failed to attach: "+err.Error()))
+				return
+			}
+
+			defer viewer.Leave()
 
 			go func() {
 				defer ws.Close()
-				defer stream.Close()
+				defer viewer.Leave()
+
+				for msg := range viewer.Messages() {
+					var err error
+					if msg.Notice {
+						err = websocket.Message.Send(ws, formatTerminalNotice(string(msg.Data)))
+					} else {
+						err = websocket.Message.Send(ws, msg.Data)
+					}
 
-				for {
-					buf := make([]byte, 512)
-					n, err := stream.Read(buf)
 					if err != nil {
-						l.Error("error reading from pod stream", "reason", err, "podId", podId)
-
-						// this might be because the container exited
-						getAndUpdatePodInspectDataLater(app, pm, id)
+						l.Error("error writing to websocket", "reason", err, "podId", podId)
 						return
 					}
 
-					if err := websocket.Message.Send(ws, buf[:n]); err != nil {
-						l.Error("error writing to websocket", "reason", err, "podId", podId)
-						return
+					if !msg.Notice {
+						idle.touch(id)
 					}
 				}
 			}()
@@ -227,7 +272,13 @@ func makeApiNoroomPodAttach(app *pocketbase.PocketBase, pm *pods.PodServerManage
 					return
 				}
 
-				if _, err := stream.Write(msg); err != nil {
+				idle.touch(id)
+
+				if _, err := viewer.Write(msg); err != nil {
+					if errors.Is(err, pods.ErrReadOnlyViewer) {
+						continue
+					}
+
 					app.Logger().Error("error writing to pod stream", "reason", err, "podId", podId)
 					return
 				}
@@ -238,6 +289,101 @@ func makeApiNoroomPodAttach(app *pocketbase.PocketBase, pm *pods.PodServerManage
 	}
 }
 
+func makeApiNoroomPodResize(
+	app *pocketbase.PocketBase,
+	pm *pods.PodServerManager,
+	sm *pods.SessionManager,
+	validate *validator.Validate,
+) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		type bodyModel struct {
+			Cols uint `json:"cols" validate:"required,max=1000"`
+			Rows uint `json:"rows" validate:"required,max=1000"`
+		}
+
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		var body bodyModel
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+
+		if err := validate.Struct(body); err != nil {
+			return err
+		}
+
+		pod, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		if err := requirePodRole(app, info, pod, podRoleOperator); err != nil {
+			return err
+		}
+
+		podId := pod.GetString("podId")
+		if err := pm.ResizePodById(podId, body.Cols, body.Rows); err != nil {
+			return err
+		}
+
+		sm.Resize(podId, int(body.Cols), int(body.Rows))
+
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+func makeApiNoroomPodViewers(app *pocketbase.PocketBase, sm *pods.SessionManager) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		pod, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		if err := requirePodRole(app, info, pod, podRoleViewer); err != nil {
+			return err
+		}
+
+		viewers := sm.Viewers(pod.GetString("podId"))
+		if viewers == nil {
+			viewers = []pods.ViewerInfo{}
+		}
+
+		return c.JSON(http.StatusOK, viewers)
+	}
+}
+
+// Notices are sent as text frames, the terminal shows them dimmed on a line
+// of their own.
+func formatTerminalNotice(notice string) string {
+	return fmt.Sprintf("\r\n\x1b[2m[noroom] %s\x1b[0m\r\n", notice)
+}
+
+// The pod stream of a session ends when the container exits, or when the pod
+// server goes away.
+func makeOnSessionEnd(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(podId string) {
+	return func(podId string) {
+		pod, err := app.Dao().FindFirstRecordByData("pods", "podId", podId)
+		if err != nil {
+			app.Logger().Error("failed to find pod of ended session", "podId", podId, "reason", err)
+			return
+		}
+
+		getAndUpdatePodInspectDataLater(app, pm, pod.Id)
+	}
+}
+
 func getAndUpdatePodInspectDataLater(app *pocketbase.PocketBase, pm *pods.PodServerManager, id string) {
 	go func() {
 		<-time.After(time.Millisecond * 500)
@@ -266,7 +412,7 @@ func getAndUpdatePodInspectData(app *pocketbase.PocketBase, pm *pods.PodServerMa
 func updatePodInspectData(
 	app *pocketbase.PocketBase,
 	id string,
-	data *rpc.ContainerInspectResult,
+	data *rpc.ContainerInspectExtendedResult,
 ) error {
 	return app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
 		pod, err := txDao.FindRecordById("pods", id)
@@ -277,12 +423,38 @@ func updatePodInspectData(
 		form := forms.NewRecordUpsert(app, pod)
 		form.SetDao(txDao)
 
-		s := data.State
-		form.LoadData(map[string]any{
-			"running": s.Running,
-			"status":  s.Status,
-		})
+		form.LoadData(podInspectFields(data))
 
 		return form.Submit()
 	})
 }
+
+// The subset of the inspect data that is kept on the pod record. Env is left
+// out on purpose, even redacted.
+func podInspectFields(data *rpc.ContainerInspectExtendedResult) map[string]any {
+	health := ""
+	if data.Health != nil {
+		health = data.Health.Status
+	}
+
+	ipAddress := ""
+	if len(data.Networks) > 0 {
+		ipAddress = data.Networks[0].IPAddress
+	}
+
+	return map[string]any{
+		"running":      data.State.Running,
+		"status":       data.State.Status,
+		"health":       health,
+		"restartCount": data.RestartCount,
+		"ipAddress":    ipAddress,
+		"inspect": map[string]any{
+			"health":    data.Health,
+			"mounts":    data.Mounts,
+			"networks":  data.Networks,
+			"ports":     data.Ports,
+			"resources": data.Resources,
+			"labels":    data.Labels,
+		},
+	}
+}
@@ -0,0 +1,152 @@
+package pods
+
+import (
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"noroom/rpc"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	ServerStatusOnline  = "online"
+	ServerStatusOffline = "offline"
+)
+
+const (
+	healthCheckInterval = 15 * time.Second
+	pingTimeout         = 5 * time.Second
+
+	// a slow or lost ping is retried sooner, the connection (and with it the
+	// streams of every pod) is only dropped after this many failures in a row
+	maxPingFailures   = 3
+	pingRetryInterval = 5 * time.Second
+
+	// reconnect attempts start at the minimum and double up to the maximum
+	reconnectBackoffMin = time.Second
+	reconnectBackoffMax = time.Minute
+)
+
+var errNotConnected = errors.New("pod server is not connected")
+
+type ServerHealth struct {
+	Status string
+	// zero until the first successful ping
+	LastSeen  time.Time
+	Latency   time.Duration
+	LastError string
+}
+
+// Called after every health check of a server, from a goroutine per server.
+// Must be set before adding servers.
+func (m *PodServerManager) OnServerHealth(fn func(serverId string, health ServerHealth)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.onHealth = fn
+}
+
+// Pings the server for as long as it is managed. A server without a
+// connection, or that missed maxPingFailures pings in a row, is reconnected
+// with jittered exponential backoff until it answers again. This is the only
+// place a server is reconnected once it was added, calls that fail report
+// their network errors here, see reportNetErr.
+func (p *podServer) supervise(serverId string, onHealth func(serverId string, health ServerHealth)) {
+	health := ServerHealth{Status: ServerStatusOffline}
+	backoff := reconnectBackoffMin
+	failures := 0
+
+	for {
+		wait := healthCheckInterval
+
+		latency, err := p.ping()
+		if err == nil {
+			health = ServerHealth{
+				Status:   ServerStatusOnline,
+				LastSeen: time.Now(),
+				Latency:  latency,
+			}
+
+			backoff = reconnectBackoffMin
+			failures = 0
+		} else {
+			health.LastError = err.Error()
+			failures++
+
+			if failures < maxPingFailures && !errors.Is(err, errNotConnected) {
+				wait = pingRetryInterval
+			} else {
+				health.Status = ServerStatusOffline
+				health.Latency = 0
+
+				if err := p.reconnect(); err != nil {
+					health.LastError = err.Error()
+				}
+
+				failures = 0
+				wait = jitter(backoff)
+				backoff = min(backoff*2, reconnectBackoffMax)
+			}
+		}
+
+		if onHealth != nil {
+			onHealth(serverId, health)
+		}
+
+		// errors of calls only bring the next check forward while the server
+		// is online, never the next reconnect attempt
+		reported := p.netErrs
+		if health.Status != ServerStatusOnline {
+			reported = nil
+		}
+
+		select {
+		case <-p.done:
+			return
+		case <-time.After(wait):
+		case <-reported:
+		}
+	}
+}
+
+// Fails with errNotConnected for a server that was never connected (or lost
+// its connection), opening a stream would connect it without giving its pods
+// their streams back. supervise reconnects it instead.
+func (p *podServer) ping() (time.Duration, error) {
+	var stream quic.Stream
+
+	if err := p.execCmd(func() error {
+		if !p.hasConnection() {
+			return errNotConnected
+		}
+
+		s, err := p.execOpenStream()
+		stream = s
+
+		return err
+	}); err != nil {
+		return 0, err
+	}
+
+	defer stream.Close()
+
+	if err := stream.SetDeadline(time.Now().Add(pingTimeout)); err != nil {
+		return 0, err
+	}
+
+	started := time.Now()
+	if err := rpc.NewRpcClient(stream).Ping(); err != nil {
+		return 0, err
+	}
+
+	return time.Since(started), nil
+}
+
+// Somewhere between half and all of d, so servers that went down together
+// don't reconnect in lockstep.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + rand.N(half+1)
+}
@@ -0,0 +1,92 @@
+package pods
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A draining server keeps its pods running, but takes no new ones. A server
+// in maintenance doesn't start pods either.
+const (
+	ServerModeActive      = "active"
+	ServerModeDraining    = "draining"
+	ServerModeMaintenance = "maintenance"
+)
+
+var (
+	ErrServerDraining      = errors.New("pod server is draining and takes no new pods")
+	ErrServerInMaintenance = errors.New("pod server is in maintenance")
+)
+
+// An empty mode is the same as active.
+func (m *PodServerManager) SetServerMode(serverId, mode string) error {
+	switch mode {
+	case "", ServerModeActive, ServerModeDraining, ServerModeMaintenance:
+	default:
+		return fmt.Errorf("invalid server mode: %v", mode)
+	}
+
+	srv, err := m.getServer(serverId)
+	if err != nil {
+		return err
+	}
+
+	srv.setMode(mode)
+
+	return nil
+}
+
+// Ids of the pods the manager knows about on the server.
+func (m *PodServerManager) ListPodsOnServer(serverId string) ([]string, error) {
+	srv, err := m.getServer(serverId)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.podsMutex.RLock()
+	defer srv.podsMutex.RUnlock()
+
+	podIds := make([]string, 0, len(srv.pods))
+	for podId := range srv.pods {
+		podIds = append(podIds, podId)
+	}
+
+	return podIds, nil
+}
+
+func (p *podServer) setMode(mode string) {
+	p.modeMutex.Lock()
+	defer p.modeMutex.Unlock()
+
+	if mode == "" {
+		mode = ServerModeActive
+	}
+
+	p.mode = mode
+}
+
+func (p *podServer) getMode() string {
+	p.modeMutex.RLock()
+	defer p.modeMutex.RUnlock()
+
+	return p.mode
+}
+
+func (p *podServer) checkCanCreate() error {
+	switch p.getMode() {
+	case ServerModeDraining:
+		return ErrServerDraining
+	case ServerModeMaintenance:
+		return ErrServerInMaintenance
+	default:
+		return nil
+	}
+}
+
+func (p *podServer) checkCanStart() error {
+	if p.getMode() == ServerModeMaintenance {
+		return ErrServerInMaintenance
+	}
+
+	return nil
+}
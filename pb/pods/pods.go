@@ -3,6 +3,7 @@ package pods
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -16,19 +17,48 @@ import (
 	"github.com/quic-go/quic-go"
 )
 
+var (
+	errPodServerClosed = errors.New("pod server closed")
+)
+
+// How long to wait before following the events of a server again, after the
+// stream broke.
+const eventsRetryInterval = 5 * time.Second
+
+// Label the pod servers put the key of a pod under, see rpc.PodSpec.
+const podKeyLabel = "noroom.pod"
+
+// Calls to different pods, on the same server or not, run in parallel. Calls
+// to the same pod are serialized, as each pod has a single RPC stream.
+//
+// Locks are taken in this order, and never held during a call to a pod server:
+// the manager mutex (only to find the server or pod), then the server command
+// goroutine (only to manage the connection and its streams), then the pod
+// mutex.
 type PodServerManager struct {
 	podServers map[string]*podServer
+	onEvent    func(event rpc.ContainerEvent)
+	onHealth   func(serverId string, health ServerHealth)
 
-	mutex sync.Mutex
+	mutex sync.RWMutex
 }
 
 func NewPodServerManager() *PodServerManager {
 	return &PodServerManager{
 		podServers: map[string]*podServer{},
-		mutex:      sync.Mutex{},
+		mutex:      sync.RWMutex{},
 	}
 }
 
+// Called for the container events of every server, from a goroutine per
+// server. Must be set before adding servers.
+func (m *PodServerManager) OnContainerEvent(fn func(event rpc.ContainerEvent)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.onEvent = fn
+}
+
 // in case the error is a connect error, the server is still added to the map
 func (m *PodServerManager) Add(id, addr string) error {
 	resolved, err := net.ResolveUDPAddr("udp4", addr)
@@ -36,31 +66,46 @@ func (m *PodServerManager) Add(id, addr string) error {
 		return fmt.Errorf("failed to resolve address %s: %w", addr, err)
 	}
 
+	srv, err := m.addServer(id, resolved)
+	if err != nil {
+		return err
+	}
+
+	return srv.reconnect()
+}
+
+func (m *PodServerManager) addServer(id string, addr net.Addr) (*podServer, error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
 	if _, exists := m.podServers[id]; exists {
-		return fmt.Errorf("server with id %v already added", id)
+		return nil, fmt.Errorf("server with id %v already added", id)
 	}
 
-	srv := newPodServer(resolved)
+	srv := newPodServer(addr)
 	go srv.start()
 
+	if m.onEvent != nil {
+		go srv.watchEvents(m.onEvent)
+	}
+
+	go srv.supervise(id, m.onHealth)
+
 	m.podServers[id] = srv
 
-	return srv.reconnect()
+	return srv, nil
 }
 
 func (m *PodServerManager) Del(id string) error {
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	srv, ok := m.podServers[id]
+	delete(m.podServers, id)
+	m.mutex.Unlock()
 
-	if srv, ok := m.podServers[id]; ok {
+	if ok {
 		srv.close()
 	}
 
-	delete(m.podServers, id)
-
 	return nil
 }
 
@@ -72,16 +117,17 @@ func (m *PodServerManager) Update(id, addr string) error {
 	return m.Add(id, addr)
 }
 
-func (m *PodServerManager) AddNewPodToServer(serverId, podName, podImage string) (string, error) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+func (m *PodServerManager) AddNewPodToServer(serverId string, spec rpc.PodSpec) (string, error) {
+	podServer, err := m.getServer(serverId)
+	if err != nil {
+		return "", err
+	}
 
-	podServer, ok := m.podServers[serverId]
-	if !ok {
-		return "", fmt.Errorf("no such server with id %v", serverId)
+	if err := podServer.checkCanCreate(); err != nil {
+		return "", err
 	}
 
-	podId, err := podServer.createNewPod(podName, podImage)
+	podId, err := podServer.createNewPod(spec)
 	if err != nil {
 		return "", fmt.Errorf("error adding new pod: %w", err)
 	}
@@ -90,12 +136,9 @@ func (m *PodServerManager) AddNewPodToServer(serverId, podName, podImage string)
 }
 
 func (m *PodServerManager) AddExistingPodToServer(serverId, podId string) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-
-	podServer, ok := m.podServers[serverId]
-	if !ok {
-		return fmt.Errorf("no such server with id %v", serverId)
+	podServer, err := m.getServer(serverId)
+	if err != nil {
+		return err
 	}
 
 	if err := podServer.addExistingPod(podId); err != nil {
@@ -106,12 +149,9 @@ func (m *PodServerManager) AddExistingPodToServer(serverId, podId string) error
 }
 
 func (m *PodServerManager) AddExistingPodToServerWithoutConnect(serverId, podId string) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-
-	podServer, ok := m.podServers[serverId]
-	if !ok {
-		return fmt.Errorf("no such server with id %v", serverId)
+	podServer, err := m.getServer(serverId)
+	if err != nil {
+		return err
 	}
 
 	if err := podServer.addExistingPodWithoutConnect(podId); err != nil {
@@ -121,13 +161,34 @@ func (m *PodServerManager) AddExistingPodToServerWithoutConnect(serverId, podId
 	return nil
 }
 
-func (m *PodServerManager) DeletePodFromServer(serverId, podId string, timeout time.Duration) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+// Removes a container that a create left behind without reporting it back, for
+// example because the connection broke halfway. Only a container with the
+// given name that carries the key of the pod is removed.
+func (m *PodServerManager) RemoveStrayPodFromServer(serverId, name, key string) error {
+	podServer, err := m.getServer(serverId)
+	if err != nil {
+		return err
+	}
 
-	podServer, ok := m.podServers[serverId]
-	if !ok {
-		return fmt.Errorf("no such server with id %v", serverId)
+	return podServer.withServerRpc(func(rpc *rpc.RpcClient) error {
+		data, err := rpc.Inspect(name)
+		if err != nil {
+			// most likely there is nothing to clean up
+			return nil
+		}
+
+		if data.Labels[podKeyLabel] != key {
+			return nil
+		}
+
+		return rpc.Delete(data.Id)
+	})
+}
+
+func (m *PodServerManager) DeletePodFromServer(serverId, podId string, timeout time.Duration) error {
+	podServer, err := m.getServer(serverId)
+	if err != nil {
+		return err
 	}
 
 	if err := podServer.deletePod(podId, timeout); err != nil {
@@ -138,17 +199,18 @@ func (m *PodServerManager) DeletePodFromServer(serverId, podId string, timeout t
 }
 
 func (m *PodServerManager) StartPodById(podId string, timeout time.Duration) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-
 	// log.Println("StartPodById:", podId)
 	srv, pod := m.findPodById(podId)
 	if srv == nil {
 		return fmt.Errorf("no such pod with id %v", podId)
 	}
 
+	if err := srv.checkCanStart(); err != nil {
+		return err
+	}
+
 	if err := pod.start(timeout); err != nil {
-		srv.reconnectIfNetErr(err)
+		srv.renewPodStreamIfNetErr(pod, err)
 		return err
 	}
 
@@ -156,9 +218,6 @@ func (m *PodServerManager) StartPodById(podId string, timeout time.Duration) err
 }
 
 func (m *PodServerManager) StopPodById(podId string, timeout time.Duration) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-
 	srv, pod := m.findPodById(podId)
 	if srv == nil {
 		return fmt.Errorf("no such pod with id %v", podId)
@@ -166,7 +225,7 @@ func (m *PodServerManager) StopPodById(podId string, timeout time.Duration) erro
 
 	// log.Println("StopPodById:", podId)
 	if err := pod.stop(timeout); err != nil {
-		srv.reconnectIfNetErr(err)
+		srv.renewPodStreamIfNetErr(pod, err)
 		return err
 	}
 
@@ -174,9 +233,6 @@ func (m *PodServerManager) StopPodById(podId string, timeout time.Duration) erro
 }
 
 func (m *PodServerManager) KillPodById(podId string, timeout time.Duration) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-
 	srv, pod := m.findPodById(podId)
 	if srv == nil {
 		return fmt.Errorf("no such pod with id %v", podId)
@@ -184,17 +240,14 @@ func (m *PodServerManager) KillPodById(podId string, timeout time.Duration) erro
 
 	// log.Println("KillPodById:", podId)
 	if err := pod.kill(timeout); err != nil {
-		srv.reconnectIfNetErr(err)
+		srv.renewPodStreamIfNetErr(pod, err)
 		return err
 	}
 
 	return nil
 }
 
-func (m *PodServerManager) InspectPodById(podId string) (*rpc.ContainerInspectResult, error) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-
+func (m *PodServerManager) InspectPodById(podId string) (*rpc.ContainerInspectExtendedResult, error) {
 	srv, pod := m.findPodById(podId)
 	if srv == nil {
 		return nil, fmt.Errorf("no such pod with id %v", podId)
@@ -203,168 +256,725 @@ func (m *PodServerManager) InspectPodById(podId string) (*rpc.ContainerInspectRe
 	// log.Println("InspectPodById:", podId)
 	data, err := pod.inspect()
 	if err != nil {
-		srv.reconnectIfNetErr(err)
+		srv.renewPodStreamIfNetErr(pod, err)
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (m *PodServerManager) StatsPodById(podId string) (*rpc.ContainerStats, error) {
+	srv, pod := m.findPodById(podId)
+	if srv == nil {
+		return nil, fmt.Errorf("no such pod with id %v", podId)
+	}
+
+	data, err := pod.stats()
+	if err != nil {
+		srv.renewPodStreamIfNetErr(pod, err)
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (m *PodServerManager) ResizePodById(podId string, cols, rows uint) error {
+	srv, pod := m.findPodById(podId)
+	if srv == nil {
+		return fmt.Errorf("no such pod with id %v", podId)
+	}
+
+	if err := pod.resize(cols, rows); err != nil {
+		srv.renewPodStreamIfNetErr(pod, err)
+		return err
+	}
+
+	return nil
+}
+
+func (m *PodServerManager) SetPodRestartPolicyById(podId string, policy rpc.RestartPolicy) error {
+	srv, pod := m.findPodById(podId)
+	if srv == nil {
+		return fmt.Errorf("no such pod with id %v", podId)
+	}
+
+	if err := pod.setRestartPolicy(policy); err != nil {
+		srv.renewPodStreamIfNetErr(pod, err)
+		return err
+	}
+
+	return nil
+}
+
+func (m *PodServerManager) AttachPodById(podId string) (quic.Stream, error) {
+	srv, pod := m.findPodById(podId)
+	if srv == nil {
+		return nil, fmt.Errorf("no such pod with id %v", podId)
+	}
+
+	// the pod stream becomes the attach, so the pod needs a new one for the
+	// calls that come after
+	next, err := srv.openStream()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := pod.attach(next)
+	if err != nil {
+		next.Close()
+		srv.renewPodStreamIfNetErr(pod, err)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// The snapshot is tagged with the given key, which should stay the same for
+// the lifetime of the pod (unlike the pod id).
+func (m *PodServerManager) SnapshotPodById(podId, key, tag string, timeout time.Duration) (string, error) {
+	srv, pod := m.findPodById(podId)
+	if srv == nil {
+		return "", fmt.Errorf("no such pod with id %v", podId)
+	}
+
+	image, err := pod.snapshot(key, tag, timeout)
+	if err != nil {
+		srv.renewPodStreamIfNetErr(pod, err)
+		return "", err
+	}
+
+	return image, nil
+}
+
+// Recreates the pod from the snapshot image. The pod gets a new id, which is
+// returned.
+func (m *PodServerManager) RestorePodSnapshotById(podId, image string, timeout time.Duration) (string, error) {
+	srv, pod := m.findPodById(podId)
+	if srv == nil {
+		return "", fmt.Errorf("no such pod with id %v", podId)
+	}
+
+	newPodId, err := pod.restoreSnapshot(image, timeout)
+	if err != nil {
+		srv.renewPodStreamIfNetErr(pod, err)
+		return "", err
+	}
+
+	if err := srv.replacePod(podId, newPodId); err != nil {
+		return "", err
+	}
+
+	return newPodId, nil
+}
+
+func (m *PodServerManager) ListSnapshotsOnServer(serverId, key string) ([]rpc.SnapshotInfo, error) {
+	podServer, err := m.getServer(serverId)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := podServer.listSnapshots(key)
+	if err != nil {
+		return nil, fmt.Errorf("error listing snapshots: %w", err)
+	}
+
+	return snapshots, nil
+}
+
+func (m *PodServerManager) DeleteSnapshotFromServer(serverId, image string) error {
+	podServer, err := m.getServer(serverId)
+	if err != nil {
+		return err
+	}
+
+	if err := podServer.deleteSnapshot(image); err != nil {
+		return fmt.Errorf("error deleting snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// Opens a connection to a TCP port inside the pod. Each call uses its own
+// stream, so any number of connections can be open at the same time.
+func (m *PodServerManager) ForwardPodById(podId string, port int) (net.Conn, error) {
+	srv, _ := m.findPodById(podId)
+	if srv == nil {
+		return nil, fmt.Errorf("no such pod with id %v", podId)
+	}
+
+	conn, err := srv.forwardPod(podId, port)
+	if err != nil {
+		return nil, fmt.Errorf("error forwarding pod port: %w", err)
+	}
+
+	return conn, nil
+}
+
+func (m *PodServerManager) ListVolumesOnServer(serverId string) ([]rpc.VolumeInfo, error) {
+	podServer, err := m.getServer(serverId)
+	if err != nil {
+		return nil, err
+	}
+
+	volumes, err := podServer.listVolumes()
+	if err != nil {
+		return nil, fmt.Errorf("error listing volumes: %w", err)
+	}
+
+	return volumes, nil
+}
+
+func (m *PodServerManager) GetVolumeSizeOnServer(serverId, name string) (int64, error) {
+	podServer, err := m.getServer(serverId)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := podServer.volumeSize(name)
+	if err != nil {
+		return 0, fmt.Errorf("error getting volume size: %w", err)
+	}
+
+	return size, nil
+}
+
+// The returned archive is a tar stream of the volume contents, it must be
+// closed by the caller.
+func (m *PodServerManager) BackupVolumeFromServer(serverId, name string) (io.ReadCloser, error) {
+	podServer, err := m.getServer(serverId)
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := podServer.backupVolume(name)
+	if err != nil {
+		return nil, fmt.Errorf("error backing up volume: %w", err)
+	}
+
+	return archive, nil
+}
+
+func (m *PodServerManager) RestoreVolumeToServer(serverId, name string, archive io.Reader) error {
+	podServer, err := m.getServer(serverId)
+	if err != nil {
+		return err
+	}
+
+	if err := podServer.restoreVolume(name, archive); err != nil {
+		return fmt.Errorf("error restoring volume: %w", err)
+	}
+
+	return nil
+}
+
+func (m *PodServerManager) ExportSnapshotFromServer(serverId, image string) (io.ReadCloser, error) {
+	podServer, err := m.getServer(serverId)
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := podServer.exportSnapshot(image)
+	if err != nil {
+		return nil, fmt.Errorf("error exporting snapshot: %w", err)
+	}
+
+	return archive, nil
+}
+
+func (m *PodServerManager) ImportSnapshotToServer(serverId string, archive io.Reader) error {
+	podServer, err := m.getServer(serverId)
+	if err != nil {
+		return err
+	}
+
+	if err := podServer.importSnapshot(archive); err != nil {
+		return fmt.Errorf("error importing snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func (m *PodServerManager) DeleteVolumeFromServer(serverId, name string) error {
+	podServer, err := m.getServer(serverId)
+	if err != nil {
+		return err
+	}
+
+	if err := podServer.deleteVolume(name); err != nil {
+		return fmt.Errorf("error deleting volume: %w", err)
+	}
+
+	return nil
+}
+
+func (m *PodServerManager) getServer(serverId string) (*podServer, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	podServer, ok := m.podServers[serverId]
+	if !ok {
+		return nil, fmt.Errorf("no such server with id %v", serverId)
+	}
+
+	return podServer, nil
+}
+
+func (m *PodServerManager) findPodById(podId string) (*podServer, *podInstance) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, srv := range m.podServers {
+		if pod := srv.getPod(podId); pod != nil {
+			return srv, pod
+		}
+	}
+
+	return nil, nil
+}
+
+// ============================================================================
+
+// The connection is only touched from the goroutine running the commands, so
+// reconnecting can't race with opening streams. Calls on the streams happen
+// outside of it.
+type podServer struct {
+	addr net.Addr
+	tr   *quic.Transport
+	conn quic.Connection
+
+	pods      map[string]*podInstance
+	podsMutex sync.RWMutex
+
+	mode      string
+	modeMutex sync.RWMutex
+
+	cmds chan podServerCmd
+	// closed once the server is removed from the manager
+	done chan struct{}
+	// network errors of calls, for the supervisor
+	netErrs chan struct{}
+}
+
+type podServerCmd struct {
+	exec func() error
+	ret  chan error
+}
+
+func newPodServer(addr net.Addr) *podServer {
+	s := &podServer{
+		addr:    addr,
+		pods:    map[string]*podInstance{},
+		mode:    ServerModeActive,
+		cmds:    make(chan podServerCmd),
+		done:    make(chan struct{}),
+		netErrs: make(chan struct{}, 1),
+	}
+
+	return s
+}
+
+func (p *podServer) start() {
+	for {
+		select {
+		case cmd := <-p.cmds:
+			cmd.ret <- cmd.exec()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Commands sent after closing fail with errPodServerClosed.
+func (p *podServer) close() {
+	p.execCmd(func() error {
+		p.execCloseFailure()
+		return nil
+	})
+
+	close(p.done)
+}
+
+// Follows the container events of the server for as long as it is managed,
+// opening the event stream again whenever it breaks.
+func (p *podServer) watchEvents(onEvent func(event rpc.ContainerEvent)) {
+	for {
+		events, err := p.openEvents()
+		if err == nil {
+			dec := json.NewDecoder(events)
+			for {
+				var event rpc.ContainerEvent
+				if err := dec.Decode(&event); err != nil {
+					break
+				}
+
+				onEvent(event)
+			}
+
+			events.Close()
+		}
+
+		select {
+		case <-p.done:
+			return
+		case <-time.After(eventsRetryInterval):
+		}
+	}
+}
+
+func (p *podServer) openEvents() (io.ReadCloser, error) {
+	stream, err := p.openStream()
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := rpc.NewRpcClient(stream).Events()
+	if err != nil {
+		stream.Close()
+		p.reportNetErr(err)
+		return nil, err
+	}
+
+	return &streamReadCloser{Reader: events, stream: stream}, nil
+}
+
+func (p *podServer) reconnect() error {
+	return p.execCmd(func() error {
+		return p.execReconnect()
+	})
+}
+
+// Errors on the stream of a pod only break that stream, so it is replaced
+// with a new one on the same connection. The connection itself is left to
+// the supervisor.
+func (p *podServer) renewPodStreamIfNetErr(pod *podInstance, err error) {
+	if !isNetErr(err) {
+		return
+	}
+
+	stream, err := p.openStream()
+	if err != nil {
+		p.reportNetErr(err)
+		return
+	}
+
+	pod.reset(stream)
+}
+
+// Wakes the supervisor up, so it checks the server right away instead of at
+// the next health check. Reports are coalesced, and ignored while the
+// supervisor is backing off.
+func (p *podServer) reportNetErr(err error) {
+	if !isNetErr(err) {
+		return
+	}
+
+	select {
+	case p.netErrs <- struct{}{}:
+	default:
+	}
+}
+
+func (p *podServer) openStream() (quic.Stream, error) {
+	var stream quic.Stream
+
+	if err := p.execCmd(func() error {
+		s, err := p.execOpenStream()
+		stream = s
+
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (p *podServer) getPod(podId string) *podInstance {
+	p.podsMutex.RLock()
+	defer p.podsMutex.RUnlock()
+
+	return p.pods[podId]
+}
+
+func (p *podServer) createNewPod(spec rpc.PodSpec) (string, error) {
+	stream, err := p.openStream()
+	if err != nil {
+		return "", err
+	}
+
+	podId, err := rpc.NewRpcClient(stream).Create(spec)
+	if err != nil {
+		stream.Close()
+		p.reportNetErr(err)
+		return "", err
+	}
+
+	if err := p.addPod(newPodInstance(podId, stream)); err != nil {
+		stream.Close()
+		return "", err
+	}
+
+	// log.Println("created new pod with id:", podId)
+
+	return podId, nil
+}
+
+func (p *podServer) addExistingPod(podId string) error {
+	return p.execCmd(func() error {
+		return p.execAddExistingPod(podId)
+	})
+}
+
+func (p *podServer) addExistingPodWithoutConnect(podId string) error {
+	return p.execCmd(func() error {
+		return p.execAddExistingPodWithoutConnect(podId)
+	})
+}
+
+func (p *podServer) addPod(pod *podInstance) error {
+	p.podsMutex.Lock()
+	defer p.podsMutex.Unlock()
+
+	if _, exists := p.pods[pod.podId]; exists {
+		return fmt.Errorf("pod with id %v already added", pod.podId)
+	}
+
+	p.pods[pod.podId] = pod
+
+	return nil
+}
+
+func (p *podServer) removePod(podId string) (*podInstance, error) {
+	p.podsMutex.Lock()
+	defer p.podsMutex.Unlock()
+
+	pod, exists := p.pods[podId]
+	if !exists {
+		return nil, fmt.Errorf("pod with id %v does not exist", podId)
+	}
+
+	delete(p.pods, podId)
+
+	return pod, nil
+}
+
+func (p *podServer) deletePod(podId string, timeout time.Duration) error {
+	pod, err := p.removePod(podId)
+	if err != nil {
+		return err
+	}
+
+	defer pod.close()
+
+	// a pod that is already stopped fails to be killed, only the removal of
+	// its container matters
+	if err := pod.kill(timeout); err != nil {
+		log.Printf("failed to kill pod %v: %v", podId, err)
+	}
+
+	if err := pod.delete(); err != nil {
+		p.reportNetErr(err)
+		return err
+	}
+
+	return nil
+}
+
+func (p *podServer) replacePod(oldPodId, newPodId string) error {
+	pod, err := p.removePod(oldPodId)
+	if err != nil {
+		return err
+	}
+
+	pod.close()
+
+	// keep track of the pod even without a stream, the next reconnect fixes it
+	stream, err := p.openStream()
+	if err != nil {
+		log.Println("failed to open stream for pod with id", newPodId)
+	}
+
+	return p.addPod(newPodInstance(newPodId, stream))
+}
+
+func (p *podServer) listSnapshots(key string) ([]rpc.SnapshotInfo, error) {
+	var snapshots []rpc.SnapshotInfo
+
+	if err := p.withServerRpc(func(rpc *rpc.RpcClient) error {
+		s, err := rpc.SnapshotList(key)
+		snapshots = s
+
+		return err
+	}); err != nil {
 		return nil, err
 	}
 
-	return data, nil
+	return snapshots, nil
 }
 
-func (m *PodServerManager) AttachPodById(podId string) (quic.Stream, error) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+func (p *podServer) deleteSnapshot(image string) error {
+	return p.withServerRpc(func(rpc *rpc.RpcClient) error {
+		return rpc.SnapshotDelete(image)
+	})
+}
 
-	srv, pod := m.findPodById(podId)
-	if srv == nil {
-		return nil, fmt.Errorf("no such pod with id %v", podId)
-	}
+func (p *podServer) forwardPod(podId string, port int) (net.Conn, error) {
+	var stream quic.Stream
+	var local, remote net.Addr
 
-	// log.Println("InspectPodById:", podId)
-	err := pod.attach()
-	if err != nil {
-		srv.reconnectIfNetErr(err)
+	if err := p.execCmd(func() error {
+		s, err := p.execOpenStream()
+		if err != nil {
+			return err
+		}
+
+		stream = s
+		local = p.conn.LocalAddr()
+		remote = p.conn.RemoteAddr()
+
+		return nil
+	}); err != nil {
 		return nil, err
 	}
 
-	stream := pod.stream
-
-	if err := srv.openRpcForPod(podId); err != nil {
-		srv.reconnectIfNetErr(err)
+	r, err := rpc.NewRpcClient(stream).Forward(podId, port)
+	if err != nil {
+		stream.Close()
+		p.reportNetErr(err)
 		return nil, err
 	}
 
-	return stream, nil
+	return &forwardConn{
+		Stream: stream,
+		r:      r,
+		local:  local,
+		remote: remote,
+	}, nil
 }
 
-func (m *PodServerManager) findPodById(podId string) (*podServer, *podInstance) {
-	for _, srv := range m.podServers {
-		pod, ok := srv.pods[podId]
-		if ok {
-			return srv, pod
-		}
+func (p *podServer) listVolumes() ([]rpc.VolumeInfo, error) {
+	var volumes []rpc.VolumeInfo
+
+	if err := p.withServerRpc(func(rpc *rpc.RpcClient) error {
+		v, err := rpc.VolumeList()
+		volumes = v
+
+		return err
+	}); err != nil {
+		return nil, err
 	}
 
-	return nil, nil
+	return volumes, nil
 }
 
-// ============================================================================
+func (p *podServer) volumeSize(name string) (int64, error) {
+	var size int64
 
-type podServer struct {
-	addr net.Addr
-	tr   *quic.Transport
-	conn quic.Connection
+	if err := p.withServerRpc(func(rpc *rpc.RpcClient) error {
+		s, err := rpc.VolumeSize(name)
+		size = s
 
-	pods map[string]*podInstance
-	cmds chan podServerCmd
-}
+		return err
+	}); err != nil {
+		return 0, err
+	}
 
-type podServerCmd struct {
-	exec func() error
-	ret  chan error
+	return size, nil
 }
 
-func newPodServer(addr net.Addr) *podServer {
-	s := &podServer{
-		addr: addr,
-		pods: map[string]*podInstance{},
-		cmds: make(chan podServerCmd),
+func (p *podServer) backupVolume(name string) (io.ReadCloser, error) {
+	stream, err := p.openStream()
+	if err != nil {
+		return nil, err
 	}
 
-	return s
-}
-
-func (p *podServer) start() {
-	for cmd := range p.cmds {
-		cmd.ret <- cmd.exec()
+	archive, err := rpc.NewRpcClient(stream).VolumeBackup(name)
+	if err != nil {
+		stream.Close()
+		p.reportNetErr(err)
+		return nil, err
 	}
+
+	return &streamReadCloser{Reader: archive, stream: stream}, nil
 }
 
-func (p *podServer) close() {
-	p.execCmd(func() error {
-		p.execCloseFailure()
-		return nil
-	})
+func (p *podServer) restoreVolume(name string, archive io.Reader) error {
+	stream, err := p.openStream()
+	if err != nil {
+		return err
+	}
 
-	close(p.cmds)
-}
+	// the client already closes our side when all goes well
+	defer stream.Close()
+	defer stream.CancelRead(0)
 
-func (p *podServer) reconnect() error {
-	return p.execCmd(func() error {
-		return p.execReconnect()
-	})
-}
+	if err := rpc.NewRpcClient(stream).VolumeRestore(name, archive); err != nil {
+		p.reportNetErr(err)
+		return err
+	}
 
-func (p *podServer) reconnectIfNetErr(err error) {
-	p.execCmd(func() error {
-		p.execReconnectIfNet(err)
-		return nil
-	})
+	return nil
 }
 
-func (p *podServer) openRpcForPod(podId string) error {
-	return p.execCmd(func() error {
-		return p.execOpenRpcForPod(podId)
-	})
-}
+func (p *podServer) exportSnapshot(image string) (io.ReadCloser, error) {
+	stream, err := p.openStream()
+	if err != nil {
+		return nil, err
+	}
 
-func (p *podServer) createNewPod(name, image string) (string, error) {
-	vid := new(string)
+	archive, err := rpc.NewRpcClient(stream).SnapshotExport(image)
+	if err != nil {
+		stream.Close()
+		p.reportNetErr(err)
+		return nil, err
+	}
 
-	if err := p.execCmd(func() error {
-		id, err := p.execCreatePod(name, image)
-		*vid = id
+	return &streamReadCloser{Reader: archive, stream: stream}, nil
+}
 
+func (p *podServer) importSnapshot(archive io.Reader) error {
+	stream, err := p.openStream()
+	if err != nil {
 		return err
-	}); err != nil {
-		return "", err
 	}
 
-	return *vid, nil
-}
-
-func (p *podServer) addExistingPod(podId string) error {
-	return p.execCmd(func() error {
-		return p.execAddExistingPod(podId)
-	})
-}
+	// the client already closes our side when all goes well
+	defer stream.Close()
+	defer stream.CancelRead(0)
 
-func (p *podServer) addExistingPodWithoutConnect(podId string) error {
-	return p.execCmd(func() error {
-		return p.execAddExistingPodWithoutConnect(podId)
-	})
-}
+	if err := rpc.NewRpcClient(stream).SnapshotImport(archive); err != nil {
+		p.reportNetErr(err)
+		return err
+	}
 
-func (p *podServer) updateConnectedPodUnlocked(podId string) error {
-	return p.execCmd(func() error {
-		return p.execUpdateConnectedPod(podId)
-	})
+	return nil
 }
 
-func (p *podServer) deletePod(podId string, timeout time.Duration) error {
-	return p.execCmd(func() error {
-		return p.execDeletePod(podId, timeout)
+func (p *podServer) deleteVolume(name string) error {
+	return p.withServerRpc(func(rpc *rpc.RpcClient) error {
+		return rpc.VolumeDelete(name, false)
 	})
 }
 
-// ----------------------------------------------------------------------------
-
-func (p *podServer) openStream() (quic.Stream, error) {
-	// log.Println("podServer.openStream()")
-	conn, err := p.getConnection()
+// Runs server level calls (not bound to any pod) on a short-lived stream.
+func (p *podServer) withServerRpc(fn func(rpc *rpc.RpcClient) error) error {
+	stream, err := p.openStream()
 	if err != nil {
-		p.execCloseFailure()
-		return nil, err
+		return err
 	}
 
-	stream, err := conn.OpenStream()
-	if err != nil {
-		p.execCloseFailure()
-		return nil, err
+	defer stream.Close()
+
+	if err := fn(rpc.NewRpcClient(stream)); err != nil {
+		p.reportNetErr(err)
+		return err
 	}
 
-	return stream, nil
+	return nil
 }
 
+// ----------------------------------------------------------------------------
+
 func (p *podServer) getConnection() (quic.Connection, error) {
 	if p.tr == nil {
 		tr, err := makeQuicTransport()
@@ -422,59 +1032,36 @@ func makeQuicTransport() (*quic.Transport, error) {
 func (p *podServer) execCmd(exec func() error) error {
 	ret := make(chan error)
 
-	p.cmds <- podServerCmd{
-		exec: exec,
-		ret:  ret,
+	select {
+	case p.cmds <- podServerCmd{exec: exec, ret: ret}:
+	case <-p.done:
+		return errPodServerClosed
 	}
 
 	return <-ret
 }
 
-func (p *podServer) execOpenRpcForPod(podId string) error {
-	stream, err := p.openStream()
-	if err != nil {
-		return err
-	}
-
-	rpc := rpc.NewRpcClient(stream)
-	p.pods[podId] = newPodInstance(podId, stream, rpc)
-	// log.Println("opened new stream for pod with id:", podId)
-
-	return nil
-}
-
-func (p *podServer) execCreatePod(name, image string) (string, error) {
-	stream, err := p.openStream()
+func (p *podServer) execOpenStream() (quic.Stream, error) {
+	// log.Println("podServer.execOpenStream()")
+	conn, err := p.getConnection()
 	if err != nil {
-		return "", err
+		p.execCloseFailure()
+		return nil, err
 	}
 
-	rpc := rpc.NewRpcClient(stream)
-
-	podId, err := rpc.Create(name, image)
+	stream, err := conn.OpenStream()
 	if err != nil {
-		p.execReconnectIfNet(err)
-		return "", err
-	}
-
-	if _, exists := p.pods[podId]; exists {
-		return "", fmt.Errorf("pod with id %v already added", podId)
+		p.execCloseFailure()
+		return nil, err
 	}
 
-	p.pods[podId] = newPodInstance(podId, stream, rpc)
-	// log.Println("created new pod with id:", podId)
-
-	return podId, nil
+	return stream, nil
 }
 
 func (p *podServer) execAddExistingPodWithoutConnect(podId string) error {
-	if _, exists := p.pods[podId]; exists {
-		return fmt.Errorf("pod with id %v already added", podId)
-	}
-
 	var stream quic.Stream
 	if p.hasConnection() {
-		s, err := p.openStream()
+		s, err := p.execOpenStream()
 		if err != nil {
 			log.Println("failed to open stream for pod with id", podId)
 		} else {
@@ -482,65 +1069,34 @@ func (p *podServer) execAddExistingPodWithoutConnect(podId string) error {
 		}
 	}
 
-	rpc := rpc.NewRpcClient(stream)
-	p.pods[podId] = newPodInstance(podId, stream, rpc)
+	if err := p.addPod(newPodInstance(podId, stream)); err != nil {
+		if stream != nil {
+			stream.Close()
+		}
+
+		return err
+	}
+
 	// log.Println("added existing pod with id without connecting:", podId)
 
 	return nil
 }
 
 func (p *podServer) execAddExistingPod(podId string) error {
-	if _, exists := p.pods[podId]; exists {
+	if p.getPod(podId) != nil {
 		return fmt.Errorf("pod with id %v already added", podId)
 	}
 
-	stream, err := p.openStream()
+	stream, err := p.execOpenStream()
 	if err != nil {
 		return err
 	}
 
-	rpc := rpc.NewRpcClient(stream)
-	p.pods[podId] = newPodInstance(podId, stream, rpc)
-	// log.Println("added existing pod with id:", podId)
-
-	return nil
-}
-
-func (p *podServer) execDeletePod(podId string, timeout time.Duration) error {
-	pod, exists := p.pods[podId]
-	if !exists {
-		return fmt.Errorf("pod with id %v does not exist", podId)
-	}
-
-	delete(p.pods, podId)
-	if err := pod.kill(timeout); err != nil {
-		log.Printf("failed to kill pod %v: %v", podId, err)
-	}
-
-	if err := pod.delete(); err != nil {
-		log.Printf("failed to delete pod %v: %v", podId, err)
-	}
-
-	pod.close()
-
-	return nil
-}
-
-func (p *podServer) execUpdateConnectedPod(podId string) error {
-	pod, exists := p.pods[podId]
-	if !exists {
-		return fmt.Errorf("pod with id %v does not exist", podId)
-	}
-
-	pod.close()
-
-	stream, err := p.openStream()
-	if err != nil {
+	if err := p.addPod(newPodInstance(podId, stream)); err != nil {
+		stream.Close()
 		return err
 	}
 
-	rpc := rpc.NewRpcClient(stream)
-	p.pods[podId] = newPodInstance(podId, stream, rpc)
 	// log.Println("added existing pod with id:", podId)
 
 	return nil
@@ -554,23 +1110,13 @@ func (p *podServer) execCloseReconnect() {
 	p.execClose(1002, "reconnect")
 }
 
-func (p *podServer) execReconnectIfNet(err error) {
+// Timeouts, closed streams and pods that never got a stream.
+func isNetErr(err error) bool {
 	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-		// log.Println("got timeout error:", nerr)
-		if err := p.execReconnect(); err != nil {
-			log.Println("failure in execReconnectIfNet:", err)
-		}
-	} else if errors.Is(err, io.EOF) {
-		// log.Println("got EOF error:", nerr)
-		if err := p.execReconnect(); err != nil {
-			log.Println("failure in execReconnectIfNet:", err)
-		}
-	} else if errors.Is(err, rpc.ErrNilStream) {
-		// log.Println("got nil stream error:", nerr)
-		if err := p.execReconnect(); err != nil {
-			log.Println("failure in execReconnectIfNet:", err)
-		}
+		return true
 	}
+
+	return errors.Is(err, io.EOF) || errors.Is(err, rpc.ErrNilStream)
 }
 
 func (p *podServer) execClose(code quic.ApplicationErrorCode, message string) {
@@ -620,18 +1166,30 @@ func (p *podServer) execConnect() error {
 	return nil
 }
 
+// Closing the old connection first makes the calls still running on it fail
+// right away, so they let go of their pods before the streams are replaced.
 func (p *podServer) execReconnect() error {
 	p.execCloseReconnect()
 	if err := p.execConnect(); err != nil {
 		return err
 	}
 
+	p.podsMutex.RLock()
+	pods := make([]*podInstance, 0, len(p.pods))
+	for _, pod := range p.pods {
+		pods = append(pods, pod)
+	}
+	p.podsMutex.RUnlock()
+
 	var errs []error
-	for _, v := range p.pods {
-		err := p.execUpdateConnectedPod(v.podId)
+	for _, pod := range pods {
+		stream, err := p.execOpenStream()
 		if err != nil {
 			errs = append(errs, err)
+			continue
 		}
+
+		pod.reset(stream)
 	}
 
 	return errors.Join(errs...)
@@ -642,44 +1200,162 @@ func (p *podServer) execReconnect() error {
 type podInstance struct {
 	podId string
 
+	// a stream carries a single call at a time
+	mutex  sync.Mutex
 	stream quic.Stream
 	rpc    *rpc.RpcClient
 }
 
-func newPodInstance(podId string, stream quic.Stream, rpc *rpc.RpcClient) *podInstance {
+func newPodInstance(podId string, stream quic.Stream) *podInstance {
 	return &podInstance{
 		podId:  podId,
 		stream: stream,
-		rpc:    rpc,
+		rpc:    rpc.NewRpcClient(stream),
 	}
 }
 
 func (p *podInstance) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.stream != nil {
+		p.stream.Close()
+	}
+}
+
+// Replaces the stream of the pod, after a reconnect.
+func (p *podInstance) reset(stream quic.Stream) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	if p.stream != nil {
 		p.stream.Close()
 	}
+
+	p.stream = stream
+	p.rpc = rpc.NewRpcClient(stream)
 }
 
 func (p *podInstance) kill(timeout time.Duration) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	return p.rpc.Kill(p.podId, timeout)
 }
 
 func (p *podInstance) start(timeout time.Duration) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	return p.rpc.Start(p.podId, timeout)
 }
 
 func (p *podInstance) stop(timeout time.Duration) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	return p.rpc.Stop(p.podId, timeout)
 }
 
 func (p *podInstance) delete() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	return p.rpc.Delete(p.podId)
 }
 
-func (p *podInstance) inspect() (*rpc.ContainerInspectResult, error) {
+func (p *podInstance) inspect() (*rpc.ContainerInspectExtendedResult, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	return p.rpc.Inspect(p.podId)
 }
 
-func (p *podInstance) attach() error {
-	return p.rpc.Attach(p.podId)
+func (p *podInstance) stats() (*rpc.ContainerStats, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.rpc.Stats(p.podId)
+}
+
+func (p *podInstance) snapshot(key, tag string, timeout time.Duration) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.rpc.SnapshotCreate(p.podId, key, tag, timeout)
+}
+
+func (p *podInstance) restoreSnapshot(image string, timeout time.Duration) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.rpc.SnapshotRestore(p.podId, image, timeout)
+}
+
+func (p *podInstance) resize(cols, rows uint) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.rpc.Resize(p.podId, cols, rows)
+}
+
+func (p *podInstance) setRestartPolicy(policy rpc.RestartPolicy) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.rpc.SetRestartPolicy(p.podId, policy)
+}
+
+// Hands over the current stream as the attach, and keeps next for the calls
+// that come after.
+func (p *podInstance) attach(next quic.Stream) (quic.Stream, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.rpc.Attach(p.podId); err != nil {
+		return nil, err
+	}
+
+	stream := p.stream
+	p.stream = next
+	p.rpc = rpc.NewRpcClient(next)
+
+	return stream, nil
+}
+
+// ============================================================================
+
+type streamReadCloser struct {
+	io.Reader
+	stream quic.Stream
+}
+
+func (s *streamReadCloser) Close() error {
+	s.stream.CancelRead(0)
+	return s.stream.Close()
+}
+
+// Adapts a forwarded stream to net.Conn, so it can be used by http.Transport.
+type forwardConn struct {
+	quic.Stream
+	r      io.Reader
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *forwardConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *forwardConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+func (c *forwardConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *forwardConn) RemoteAddr() net.Addr {
+	return c.remote
 }
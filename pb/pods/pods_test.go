@@ -0,0 +1,199 @@
+package pods
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"noroom/rpc"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	benchServers       = 4
+	benchPodsPerServer = 8
+	// how long the fake pod server takes to answer a start or inspect
+	benchCallDelay = 20 * time.Millisecond
+)
+
+// Answers start and inspect after a delay, like docker would. Any other call
+// panics, the benchmarks never make them.
+type fakeHub struct {
+	rpc.RpcHandler
+}
+
+func (h *fakeHub) Start(ctx context.Context, id string) error {
+	time.Sleep(benchCallDelay)
+	return nil
+}
+
+func (h *fakeHub) Inspect(ctx context.Context, id string) (*rpc.ContainerInspectExtendedResult, error) {
+	time.Sleep(benchCallDelay)
+	return &rpc.ContainerInspectExtendedResult{
+		ContainerInspectResult: rpc.ContainerInspectResult{Id: id},
+	}, nil
+}
+
+func (h *fakeHub) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Serves the rpc protocol over quic on a random local port, the same way
+// pods/server does.
+func startFakePodServer(b *testing.B) string {
+	b.Helper()
+
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	tr := &quic.Transport{Conn: udpConn}
+	ln, err := tr.Listen(fakeTLSConfig(b), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Cleanup(func() {
+		ln.Close()
+		tr.Close()
+	})
+
+	hub := &fakeHub{}
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+
+					go func() {
+						defer stream.Close()
+
+						server := rpc.NewRpcServer(stream, time.Minute, hub)
+						for {
+							if _, err := server.HandleOne(context.Background()); err != nil {
+								return
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+
+	return udpConn.LocalAddr().String()
+}
+
+func fakeTLSConfig(b *testing.B) *tls.Config {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	template := x509.Certificate{SerialNumber: big.NewInt(1)}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: key}},
+		NextProtos:   []string{"noroom-rpc"},
+	}
+}
+
+// A manager with benchServers fake servers, each with benchPodsPerServer
+// pods. Returns the ids of the pods.
+func setupBenchManager(b *testing.B) (*PodServerManager, []string) {
+	b.Helper()
+
+	m := NewPodServerManager()
+
+	var podIds []string
+	for s := range benchServers {
+		serverId := fmt.Sprintf("server%d", s)
+		if err := m.Add(serverId, startFakePodServer(b)); err != nil {
+			b.Fatal(err)
+		}
+
+		b.Cleanup(func() { m.Del(serverId) })
+
+		for p := range benchPodsPerServer {
+			podId := fmt.Sprintf("%s-pod%d", serverId, p)
+			if err := m.AddExistingPodToServer(serverId, podId); err != nil {
+				b.Fatal(err)
+			}
+
+			podIds = append(podIds, podId)
+		}
+	}
+
+	return m, podIds
+}
+
+// Calls fn on every pod at once, and reports how many calls' worth of delay
+// ran at the same time. Close to the number of pods means every call ran in
+// parallel, 1 would mean they were serialized.
+func benchmarkAllPods(b *testing.B, fn func(m *PodServerManager, podId string) error) {
+	m, podIds := setupBenchManager(b)
+
+	b.ResetTimer()
+	started := time.Now()
+
+	for range b.N {
+		var wg sync.WaitGroup
+		errs := make(chan error, len(podIds))
+
+		for _, podId := range podIds {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				if err := fn(m, podId); err != nil {
+					errs <- err
+				}
+			}()
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			b.Fatal(err)
+		}
+	}
+
+	elapsed := time.Since(started)
+	serial := time.Duration(b.N*len(podIds)) * benchCallDelay
+	b.ReportMetric(float64(serial)/float64(elapsed), "parallelism")
+}
+
+func BenchmarkStartPodsAcrossServers(b *testing.B) {
+	benchmarkAllPods(b, func(m *PodServerManager, podId string) error {
+		return m.StartPodById(podId, time.Minute)
+	})
+}
+
+func BenchmarkInspectPodsAcrossServers(b *testing.B) {
+	benchmarkAllPods(b, func(m *PodServerManager, podId string) error {
+		_, err := m.InspectPodById(podId)
+		return err
+	})
+}
@@ -0,0 +1,377 @@
+package pods
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+var (
+	ErrReadOnlyViewer = errors.New("viewer is read-only")
+)
+
+// Size of the per viewer message queue. Viewers that fall this far behind are
+// dropped instead of slowing down everyone else.
+const viewerQueueSize = 256
+
+// Receives everything that goes through a session, used for recordings.
+type SessionRecorder interface {
+	Output(data []byte)
+	Resize(cols, rows int)
+	Close()
+}
+
+type SessionHooks struct {
+	// called when a session is opened, may return nil to not record it
+	OnStart func(podId string) SessionRecorder
+	// called once the pod stream of a session ends, which usually means the
+	// container exited
+	OnEnd func(podId string)
+}
+
+// Shares a single pod attach between any number of viewers. The attach is
+// opened by the first viewer and closed once the last one leaves.
+type SessionManager struct {
+	pm       *PodServerManager
+	sessions map[string]*session
+	// closed once the session of the pod is opened (or failed to), so
+	// viewers joining meanwhile wait for it instead of opening another
+	opening map[string]chan struct{}
+	hooks   SessionHooks
+
+	mutex sync.Mutex
+}
+
+func NewSessionManager(pm *PodServerManager, hooks SessionHooks) *SessionManager {
+	return &SessionManager{
+		pm:       pm,
+		sessions: map[string]*session{},
+		opening:  map[string]chan struct{}{},
+		hooks:    hooks,
+		mutex:    sync.Mutex{},
+	}
+}
+
+// Opening a session attaches to the pod and runs the start hook, neither of
+// which happens with the mutex held.
+func (sm *SessionManager) Join(podId, name string, readOnly bool) (*Viewer, error) {
+	v := &Viewer{
+		Name:     name,
+		ReadOnly: readOnly,
+		messages: make(chan SessionMessage, viewerQueueSize),
+		sm:       sm,
+	}
+
+	for {
+		sm.mutex.Lock()
+		if s, ok := sm.sessions[podId]; ok {
+			v.session = s
+			s.add(v)
+			sm.mutex.Unlock()
+
+			return v, nil
+		}
+
+		if opened, ok := sm.opening[podId]; ok {
+			sm.mutex.Unlock()
+			<-opened
+			continue
+		}
+
+		opened := make(chan struct{})
+		sm.opening[podId] = opened
+		sm.mutex.Unlock()
+
+		s, err := sm.open(podId)
+
+		sm.mutex.Lock()
+		delete(sm.opening, podId)
+		close(opened)
+
+		if err != nil {
+			sm.mutex.Unlock()
+			return nil, err
+		}
+
+		sm.sessions[podId] = s
+		v.session = s
+		s.add(v)
+		sm.mutex.Unlock()
+
+		go sm.pump(s)
+
+		return v, nil
+	}
+}
+
+func (sm *SessionManager) open(podId string) (*session, error) {
+	stream, err := sm.pm.AttachPodById(podId)
+	if err != nil {
+		return nil, err
+	}
+
+	var recorder SessionRecorder
+	if sm.hooks.OnStart != nil {
+		recorder = sm.hooks.OnStart(podId)
+	}
+
+	return newSession(podId, stream, recorder), nil
+}
+
+// Sends a notice to every viewer of the pod, if anyone is attached.
+func (sm *SessionManager) Notify(podId, notice string) {
+	sm.mutex.Lock()
+	s, ok := sm.sessions[podId]
+	sm.mutex.Unlock()
+
+	if ok {
+		s.broadcast(SessionMessage{Data: []byte(notice), Notice: true})
+	}
+}
+
+// Records a change of the terminal size, if anyone is attached.
+func (sm *SessionManager) Resize(podId string, cols, rows int) {
+	sm.mutex.Lock()
+	s, ok := sm.sessions[podId]
+	sm.mutex.Unlock()
+
+	if ok && s.recorder != nil {
+		s.recorder.Resize(cols, rows)
+	}
+}
+
+// Lists the viewers currently attached to the pod.
+func (sm *SessionManager) Viewers(podId string) []ViewerInfo {
+	sm.mutex.Lock()
+	s, ok := sm.sessions[podId]
+	sm.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return s.viewerInfos()
+}
+
+func (sm *SessionManager) leave(v *Viewer) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	s := v.session
+	if remaining := s.remove(v); remaining > 0 {
+		return
+	}
+
+	// last one out closes the attach
+	if sm.sessions[s.podId] == s {
+		delete(sm.sessions, s.podId)
+	}
+
+	s.close()
+}
+
+func (sm *SessionManager) pump(s *session) {
+	for {
+		buf := make([]byte, 512)
+		n, err := s.stream.Read(buf)
+		if err != nil {
+			if !s.isClosed() {
+				log.Printf("error reading from pod stream %v: %v", s.podId, err)
+			}
+
+			break
+		}
+
+		if s.recorder != nil {
+			s.recorder.Output(buf[:n])
+		}
+
+		s.broadcast(SessionMessage{Data: buf[:n]})
+	}
+
+	sm.mutex.Lock()
+	if sm.sessions[s.podId] == s {
+		delete(sm.sessions, s.podId)
+	}
+	sm.mutex.Unlock()
+
+	wasClosed := s.isClosed()
+	s.close()
+
+	if !wasClosed && sm.hooks.OnEnd != nil {
+		sm.hooks.OnEnd(s.podId)
+	}
+}
+
+// ============================================================================
+
+type SessionMessage struct {
+	Data []byte
+	// notices are meant for the viewer, not output of the pod
+	Notice bool
+}
+
+type ViewerInfo struct {
+	Name     string `json:"name"`
+	ReadOnly bool   `json:"readOnly"`
+}
+
+type Viewer struct {
+	Name     string
+	ReadOnly bool
+
+	messages chan SessionMessage
+	session  *session
+	sm       *SessionManager
+
+	leaveOnce sync.Once
+}
+
+// Closed when the session ends or the viewer is dropped.
+func (v *Viewer) Messages() <-chan SessionMessage {
+	return v.messages
+}
+
+func (v *Viewer) Write(p []byte) (int, error) {
+	if v.ReadOnly {
+		return 0, ErrReadOnlyViewer
+	}
+
+	return v.session.write(p)
+}
+
+func (v *Viewer) Leave() {
+	v.leaveOnce.Do(func() {
+		v.sm.leave(v)
+	})
+}
+
+func (v *Viewer) info() ViewerInfo {
+	return ViewerInfo{Name: v.Name, ReadOnly: v.ReadOnly}
+}
+
+// ============================================================================
+
+type session struct {
+	podId    string
+	stream   io.ReadWriteCloser
+	recorder SessionRecorder
+
+	viewers map[*Viewer]struct{}
+	closed  bool
+
+	mutex      sync.Mutex
+	writeMutex sync.Mutex
+}
+
+func newSession(podId string, stream io.ReadWriteCloser, recorder SessionRecorder) *session {
+	return &session{
+		podId:    podId,
+		stream:   stream,
+		recorder: recorder,
+		viewers:  map[*Viewer]struct{}{},
+	}
+}
+
+func (s *session) add(v *Viewer) {
+	s.mutex.Lock()
+	s.viewers[v] = struct{}{}
+	s.mutex.Unlock()
+
+	s.broadcast(SessionMessage{Data: []byte(joinNotice(v)), Notice: true})
+}
+
+// Returns how many viewers are left.
+func (s *session) remove(v *Viewer) int {
+	s.mutex.Lock()
+	_, ok := s.viewers[v]
+	if ok {
+		delete(s.viewers, v)
+		close(v.messages)
+	}
+	remaining := len(s.viewers)
+	s.mutex.Unlock()
+
+	if ok && remaining > 0 {
+		s.broadcast(SessionMessage{Data: []byte(leaveNotice(v)), Notice: true})
+	}
+
+	return remaining
+}
+
+func (s *session) broadcast(msg SessionMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for v := range s.viewers {
+		select {
+		case v.messages <- msg:
+		default:
+			log.Printf("dropping slow viewer %v of pod %v", v.Name, s.podId)
+			delete(s.viewers, v)
+			close(v.messages)
+		}
+	}
+}
+
+func (s *session) write(p []byte) (int, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	return s.stream.Write(p)
+}
+
+func (s *session) viewerInfos() []ViewerInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	infos := make([]ViewerInfo, 0, len(s.viewers))
+	for v := range s.viewers {
+		infos = append(infos, v.info())
+	}
+
+	return infos
+}
+
+func (s *session) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.closed
+}
+
+// Closes the pod stream and ends every viewer still attached.
+func (s *session) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	s.stream.Close()
+
+	if s.recorder != nil {
+		s.recorder.Close()
+	}
+
+	for v := range s.viewers {
+		delete(s.viewers, v)
+		close(v.messages)
+	}
+}
+
+func joinNotice(v *Viewer) string {
+	if v.ReadOnly {
+		return fmt.Sprintf("%s joined (read-only)", v.Name)
+	}
+
+	return fmt.Sprintf("%s joined", v.Name)
+}
+
+func leaveNotice(v *Viewer) string {
+	return fmt.Sprintf("%s left", v.Name)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"time"
+
+	"noroom/pb/pods"
+	"noroom/rpc"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// New pods start out provisioning, and end up ready or failed once their
+// container is created in the background. Pods from before provisioning have
+// no state, and count as ready.
+const (
+	podStateProvisioning = "provisioning"
+	podStateReady        = "ready"
+	podStateFailed       = "failed"
+)
+
+const (
+	provisionAttempts = 3
+	// doubles after every failed attempt
+	provisionRetryInterval = time.Second * 5
+)
+
+var errPodNotProvisioned = errors.New("pod is not provisioned")
+
+func provisionPodLater(app *pocketbase.PocketBase, pm *pods.PodServerManager, id string) {
+	go func() {
+		if err := provisionPod(app, pm, id); err != nil {
+			app.Logger().Error("failed to provision pod", "pod", id, "reason", err)
+		}
+	}()
+}
+
+// Creates the container of the pod, retrying a few times before giving up and
+// marking the pod as failed (the error is returned as well). Whatever a failed
+// attempt left behind on the pod server is removed before the next one.
+func provisionPod(app *pocketbase.PocketBase, pm *pods.PodServerManager, id string) error {
+	var lastErr error
+	wait := provisionRetryInterval
+
+	for attempt := 1; attempt <= provisionAttempts; attempt++ {
+		if attempt > 1 {
+			<-time.After(wait)
+			wait *= 2
+		}
+
+		// deleted while provisioning, nothing left to do
+		pod, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		spec, err := podSpecFromRecord(app, pod)
+		if err != nil {
+			// no point in trying again
+			lastErr = err
+			break
+		}
+
+		podId, err := pm.AddNewPodToServer(pod.GetString("server"), spec)
+		if err == nil {
+			return finishPodProvisioning(app, pm, pod, podId)
+		}
+
+		lastErr = err
+		app.Logger().Warn("failed to create pod container", "pod", id, "attempt", attempt, "reason", err)
+
+		if err := pm.RemoveStrayPodFromServer(pod.GetString("server"), pod.GetString("name"), pod.Id); err != nil {
+			app.Logger().Error("failed to remove stray pod container", "pod", id, "reason", err)
+		}
+	}
+
+	pod, err := app.Dao().FindRecordById("pods", id)
+	if err != nil {
+		return err
+	}
+
+	pod.Set("state", podStateFailed)
+	pod.Set("provisionError", lastErr.Error())
+
+	if err := app.Dao().SaveRecord(pod); err != nil {
+		return err
+	}
+
+	return lastErr
+}
+
+// Everything needed to create the container of the pod, on any server.
+func podSpecFromRecord(app *pocketbase.PocketBase, pod *models.Record) (rpc.PodSpec, error) {
+	spec := rpc.PodSpec{Image: pod.GetString("image")}
+	if templateId := pod.GetString("template"); templateId != "" {
+		template, err := app.Dao().FindRecordById("podTemplates", templateId)
+		if err != nil {
+			return rpc.PodSpec{}, err
+		}
+
+		spec, err = podSpecFromTemplate(template)
+		if err != nil {
+			return rpc.PodSpec{}, err
+		}
+	}
+
+	env, err := podEnvFromRecord(pod)
+	if err != nil {
+		return rpc.PodSpec{}, err
+	}
+
+	if len(env) > 0 {
+		if spec.Env == nil {
+			spec.Env = map[string]string{}
+		}
+
+		maps.Copy(spec.Env, env)
+	}
+
+	spec.Secrets, err = podSecretsEnv(app, pod)
+	if err != nil {
+		return rpc.PodSpec{}, err
+	}
+
+	spec.Key = pod.Id
+	spec.Name = pod.GetString("name")
+	spec.Volume = pod.GetString("volume")
+	spec.Restart = podRestartPolicy(pod)
+
+	return spec, nil
+}
+
+func finishPodProvisioning(app *pocketbase.PocketBase, pm *pods.PodServerManager, pod *models.Record, podId string) error {
+	serverId := pod.GetString("server")
+
+	// the pod may be gone by now, and the container with it
+	current, err := app.Dao().FindRecordById("pods", pod.Id)
+	if err == nil {
+		current.Set("podId", podId)
+		current.Set("state", podStateReady)
+		current.Set("provisionError", "")
+
+		data, err := pm.InspectPodById(podId)
+		if err != nil {
+			app.Logger().Error("failed to inspect pod after create", "podId", podId, "reason", err)
+		} else {
+			for k, v := range podInspectFields(data) {
+				current.Set(k, v)
+			}
+		}
+
+		err = app.Dao().SaveRecord(current)
+		if err == nil {
+			return nil
+		}
+	}
+
+	// cleanupDeletedPod ran before the container and its volume existed, so
+	// both are removed here
+	volume := pod.GetString("volume")
+	if pod.GetBool("keepVolume") {
+		volume = ""
+	}
+
+	deletePodAndVolumeFromServer(app, pm, serverId, podId, volume)
+
+	return err
+}
+
+// Picks up the pods that were still provisioning when the app stopped.
+func resumePodProvisioning(app *pocketbase.PocketBase, pm *pods.PodServerManager) error {
+	provisioning, err := app.Dao().FindRecordsByFilter(
+		"pods",
+		"state={:state}",
+		"",
+		0,
+		0,
+		dbx.Params{"state": podStateProvisioning},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range provisioning {
+		provisionPodLater(app, pm, pod.Id)
+	}
+
+	return nil
+}
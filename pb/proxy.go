@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+
+	"noroom/pb/pods"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+const (
+	// Browsers don't send the auth token on their own when following links
+	// inside the proxied page, so the token given in the query is kept in a
+	// cookie scoped to the proxy path of the pod.
+	proxyTokenCookie = "noroom_proxy_token"
+
+	// Proxied pages are served from the origin of the app, so they get an
+	// opaque origin instead. Otherwise any script in them could read the
+	// auth token of whoever opens them from local storage.
+	proxyContentSecurityPolicy = "sandbox allow-scripts allow-forms allow-popups allow-modals allow-downloads"
+)
+
+func makeApiNoroomPodProxy(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		// the body is for the pod, binding it here would leave nothing to proxy
+		info := requestAuthInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		port, err := strconv.Atoi(c.PathParam("port"))
+		if err != nil || port <= 0 || port > 65535 {
+			return apis.NewBadRequestError("invalid port", err)
+		}
+
+		pod, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		if err := requirePodRole(app, info, pod, podRoleOperator); err != nil {
+			return err
+		}
+
+		prefix := fmt.Sprintf("/api/noroom/pod/%s/proxy/%d/", id, port)
+		if token, _ := c.Get(contextQueryTokenKey).(string); token != "" {
+			secure := c.Scheme() == "https"
+
+			// the sandboxed page is cross-site to the app, so over https the
+			// cookie must also be sent with its own requests
+			sameSite := http.SameSiteLaxMode
+			if secure {
+				sameSite = http.SameSiteNoneMode
+			}
+
+			c.SetCookie(&http.Cookie{
+				Name:     proxyTokenCookie,
+				Value:    token,
+				Path:     prefix,
+				HttpOnly: true,
+				Secure:   secure,
+				SameSite: sameSite,
+			})
+
+			// the token was already taken out of the url, so it doesn't stay in
+			// the history of the browser either
+			if c.Request().Method == http.MethodGet || c.Request().Method == http.MethodHead {
+				return c.Redirect(http.StatusSeeOther, c.Request().URL.RequestURI())
+			}
+		}
+
+		podId := pod.GetString("podId")
+		l := app.Logger()
+
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.Out.URL.Scheme = "http"
+				r.Out.URL.Host = net.JoinHostPort("localhost", strconv.Itoa(port))
+				r.Out.URL.Path = "/" + c.PathParam("*")
+				r.Out.URL.RawPath = ""
+
+				// the pod must never see the credentials of the user
+				r.Out.Header.Del("Authorization")
+				removeCookie(r.Out, proxyTokenCookie)
+
+				r.SetXForwarded()
+			},
+			ModifyResponse: func(r *http.Response) error {
+				r.Header.Set("Content-Security-Policy", proxyContentSecurityPolicy)
+				removeSetCookie(r, proxyTokenCookie)
+
+				return nil
+			},
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return pm.ForwardPodById(podId, port)
+				},
+				DisableKeepAlives: true,
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				l.Error("error proxying to pod", "reason", err, "podId", podId, "port", port)
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		}
+
+		proxy.ServeHTTP(c.Response(), c.Request())
+
+		return nil
+	}
+}
+
+// Keeps the pod from replacing the token of the user with one of its own.
+func removeSetCookie(r *http.Response, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Set-Cookie")
+
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.Header.Add("Set-Cookie", cookie.String())
+		}
+	}
+}
+
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+
+	kept := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			kept = append(kept, cookie.String())
+		}
+	}
+
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
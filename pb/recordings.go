@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"noroom/pb/pods"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	defaultRecordingsMaxAge    = time.Hour * 24 * 30
+	defaultRecordingsMaxPerPod = 20
+
+	// the terminal size is not known when the session starts, resize events
+	// fix it up once the client reports its size
+	defaultCastWidth  = 80
+	defaultCastHeight = 24
+)
+
+type recordingSettings struct {
+	maxAge    time.Duration
+	maxPerPod int
+}
+
+func makeApiNoroomPodRecordingCast(app *pocketbase.PocketBase) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		recordingId := c.PathParam("recording")
+		if id == "" || recordingId == "" {
+			return apis.NewBadRequestError("missing id or recording", nil)
+		}
+
+		pod, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		if err := requirePodRole(app, info, pod, podRoleOwner); err != nil {
+			return err
+		}
+
+		recording, err := app.Dao().FindRecordById("podRecordings", recordingId)
+		if err != nil {
+			return err
+		}
+
+		if recording.GetString("pod") != pod.Id {
+			return apis.NewBadRequestError("recording does not belong to pod", nil)
+		}
+
+		fsys, err := app.NewFilesystem()
+		if err != nil {
+			return err
+		}
+
+		defer fsys.Close()
+
+		cast, err := fsys.GetFile(recording.BaseFilesPath() + "/" + recording.GetString("cast"))
+		if err != nil {
+			return err
+		}
+
+		defer cast.Close()
+
+		return c.Stream(http.StatusOK, "application/x-asciicast", cast)
+	}
+}
+
+func makeOnSessionStart(app *pocketbase.PocketBase, settings *recordingSettings) func(podId string) pods.SessionRecorder {
+	return func(podId string) pods.SessionRecorder {
+		pod, err := app.Dao().FindFirstRecordByData("pods", "podId", podId)
+		if err != nil {
+			app.Logger().Error("failed to find pod of new session", "podId", podId, "reason", err)
+			return nil
+		}
+
+		if !pod.GetBool("recordSessions") {
+			return nil
+		}
+
+		recorder, err := newCastRecorder(pod.GetString("name"), func(path string, started time.Time, duration time.Duration) {
+			defer os.Remove(path)
+
+			if err := saveRecording(app, pod.Id, path, started, duration); err != nil {
+				app.Logger().Error("failed to save session recording", "pod", pod.Id, "reason", err)
+				return
+			}
+
+			if err := cleanupPodRecordings(app, pod.Id, settings); err != nil {
+				app.Logger().Error("failed to cleanup session recordings", "pod", pod.Id, "reason", err)
+			}
+		})
+		if err != nil {
+			app.Logger().Error("failed to start session recording", "pod", pod.Id, "reason", err)
+			return nil
+		}
+
+		return recorder
+	}
+}
+
+func saveRecording(app *pocketbase.PocketBase, podRecordId, path string, started time.Time, duration time.Duration) error {
+	recordingsCollection, err := app.Dao().FindCollectionByNameOrId("podRecordings")
+	if err != nil {
+		return err
+	}
+
+	file, err := filesystem.NewFileFromPath(path)
+	if err != nil {
+		return err
+	}
+
+	startedAt, err := types.ParseDateTime(started)
+	if err != nil {
+		return err
+	}
+
+	form := forms.NewRecordUpsert(app, models.NewRecord(recordingsCollection))
+	form.LoadData(map[string]any{
+		"pod":      podRecordId,
+		"started":  startedAt,
+		"duration": duration.Seconds(),
+	})
+
+	if err := form.AddFiles("cast", file); err != nil {
+		return err
+	}
+
+	return form.Submit()
+}
+
+// Deletes recordings of the pod that are too old, or that go past the limit
+// of recordings per pod (oldest first).
+func cleanupPodRecordings(app *pocketbase.PocketBase, podRecordId string, settings *recordingSettings) error {
+	recordings, err := app.Dao().FindRecordsByFilter(
+		"podRecordings",
+		"pod={:pod}",
+		"-created",
+		0,
+		0,
+		dbx.Params{"pod": podRecordId},
+	)
+	if err != nil {
+		return err
+	}
+
+	return deleteExpiredRecordings(app, recordings, settings)
+}
+
+func cleanupAllRecordings(app *pocketbase.PocketBase, settings *recordingSettings) error {
+	pods, err := app.Dao().FindRecordsByExpr("pods")
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range pods {
+		if err := cleanupPodRecordings(app, pod.Id, settings); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Expects the recordings of a single pod, newest first.
+func deleteExpiredRecordings(app *pocketbase.PocketBase, recordings []*models.Record, settings *recordingSettings) error {
+	cutoff := time.Now().Add(-settings.maxAge)
+
+	for i, recording := range recordings {
+		tooMany := settings.maxPerPod > 0 && i >= settings.maxPerPod
+		tooOld := settings.maxAge > 0 && recording.Created.Time().Before(cutoff)
+		if !tooMany && !tooOld {
+			continue
+		}
+
+		if err := app.Dao().DeleteRecord(recording); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ============================================================================
+
+// Writes an asciicast v2 file (https://docs.asciinema.org/manual/asciicast/v2/)
+// to a temporary path, which is handed to onClose once the session is over.
+type castRecorder struct {
+	file    *os.File
+	started time.Time
+	// incomplete UTF-8 sequence at the end of the last output
+	pending []byte
+	closed  bool
+
+	onClose func(path string, started time.Time, duration time.Duration)
+
+	mutex sync.Mutex
+}
+
+func newCastRecorder(title string, onClose func(path string, started time.Time, duration time.Duration)) (*castRecorder, error) {
+	file, err := os.CreateTemp("", "noroom-recording-*.cast")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &castRecorder{
+		file:    file,
+		started: time.Now(),
+		onClose: onClose,
+	}
+
+	header, err := json.Marshal(map[string]any{
+		"version":   2,
+		"width":     defaultCastWidth,
+		"height":    defaultCastHeight,
+		"timestamp": r.started.Unix(),
+		"title":     title,
+	})
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	if _, err := fmt.Fprintf(file, "%s\n", header); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *castRecorder) Output(data []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	// events must be valid UTF-8, so hold back a character split between reads
+	data = append(r.pending, data...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+
+			break
+		}
+	}
+
+	r.pending = append([]byte(nil), data[cut:]...)
+	if cut > 0 {
+		r.writeEvent("o", string(data[:cut]))
+	}
+}
+
+func (r *castRecorder) Resize(cols, rows int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	r.writeEvent("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// The file is handed over in the background, closing happens while the
+// session holds its locks.
+func (r *castRecorder) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	r.closed = true
+	r.file.Close()
+
+	go r.onClose(r.file.Name(), r.started, time.Since(r.started))
+}
+
+func (r *castRecorder) writeEvent(kind, data string) {
+	event, err := json.Marshal([]any{time.Since(r.started).Seconds(), kind, data})
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(r.file, "%s\n", event)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"time"
+
+	"noroom/pb/pods"
+	"noroom/rpc"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+const (
+	// a pod that fails this many times within the window is in a crash loop
+	crashLoopThreshold = 5
+	crashLoopWindow    = time.Minute * 10
+
+	maxExitHistory = 20
+)
+
+type podExit struct {
+	Time      time.Time `json:"time"`
+	ExitCode  int       `json:"exitCode"`
+	OOMKilled bool      `json:"oomKilled"`
+}
+
+func (e podExit) failed() bool {
+	return e.ExitCode != 0 || e.OOMKilled
+}
+
+func podRestartPolicy(pod *models.Record) *rpc.RestartPolicy {
+	switch pod.GetString("restartPolicy") {
+	case "always":
+		return &rpc.RestartPolicy{Name: "always"}
+	case "on-failure":
+		return &rpc.RestartPolicy{Name: "on-failure", MaximumRetryCount: pod.GetInt("restartMaxRetries")}
+	default:
+		return &rpc.RestartPolicy{Name: "no"}
+	}
+}
+
+// Records every start and exit of a pod, for usage metering. Once a pod is
+// found in a crash loop, docker is told to stop restarting it until it is
+// started by hand again.
+func makeOnContainerEvent(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(event rpc.ContainerEvent) {
+	return func(event rpc.ContainerEvent) {
+		if event.Action != "start" && event.Action != "die" {
+			return
+		}
+
+		// not every container is a pod, snapshots and volumes use helpers
+		pod, err := app.Dao().FindFirstRecordByData("pods", "podId", event.Id)
+		if err != nil {
+			return
+		}
+
+		if event.Action == "start" {
+			if err := openPodUsage(app, pod, event.Time); err != nil {
+				app.Logger().Error("failed to record pod start", "pod", pod.Id, "reason", err)
+			}
+
+			return
+		}
+
+		if err := closePodUsage(app, pod.Id, event.Time); err != nil {
+			app.Logger().Error("failed to record pod usage", "pod", pod.Id, "reason", err)
+		}
+
+		crashLoop, err := recordPodExit(app, pod.Id, podExit{
+			Time:      event.Time,
+			ExitCode:  event.ExitCode,
+			OOMKilled: event.OOMKilled,
+		})
+		if err != nil {
+			app.Logger().Error("failed to record pod exit", "pod", pod.Id, "reason", err)
+		}
+
+		if crashLoop {
+			app.Logger().Warn("pod is in a crash loop", "pod", pod.Id, "podId", event.Id)
+
+			err := pm.SetPodRestartPolicyById(event.Id, rpc.RestartPolicy{Name: "no"})
+			auditPodSystemAction(app, pod.Id, "crashLoop", map[string]any{"podId": event.Id}, err)
+			if err != nil {
+				app.Logger().Error("failed to stop restarting crashing pod", "pod", pod.Id, "reason", err)
+			}
+		}
+
+		getAndUpdatePodInspectDataLater(app, pm, pod.Id)
+	}
+}
+
+// Returns true when the exit puts the pod in a crash loop it was not in before.
+func recordPodExit(app *pocketbase.PocketBase, id string, exit podExit) (bool, error) {
+	crashLoop := false
+
+	err := app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		pod, err := txDao.FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		var history []podExit
+		if err := pod.UnmarshalJSONField("exitHistory", &history); err != nil {
+			// start over instead of failing on a broken history
+			history = nil
+		}
+
+		history = append(history, exit)
+		if len(history) > maxExitHistory {
+			history = history[len(history)-maxExitHistory:]
+		}
+
+		failures := 0
+		cutoff := exit.Time.Add(-crashLoopWindow)
+		for _, e := range history {
+			if e.failed() && e.Time.After(cutoff) {
+				failures++
+			}
+		}
+
+		if failures >= crashLoopThreshold && !pod.GetBool("crashLoop") {
+			crashLoop = true
+			pod.Set("crashLoop", true)
+		}
+
+		pod.Set("exitHistory", history)
+
+		return txDao.SaveRecord(pod)
+	})
+
+	return crashLoop, err
+}
+
+// Starting a pod by hand gives it another chance after a crash loop.
+func resetPodCrashLoop(app *pocketbase.PocketBase, pm *pods.PodServerManager, pod *models.Record) error {
+	if !pod.GetBool("crashLoop") {
+		return nil
+	}
+
+	if err := pm.SetPodRestartPolicyById(pod.GetString("podId"), *podRestartPolicy(pod)); err != nil {
+		return err
+	}
+
+	return app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		pod, err := txDao.FindRecordById("pods", pod.Id)
+		if err != nil {
+			return err
+		}
+
+		pod.Set("crashLoop", false)
+
+		return txDao.SaveRecord(pod)
+	})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"noroom/pb/pods"
+	"noroom/rpc"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/cron"
+)
+
+const (
+	scheduleStart = "start"
+	scheduleStop  = "stop"
+)
+
+// Runs missed while the app was down are still done when it comes back, as
+// long as they are not older than this. Older ones are skipped.
+const missedScheduleWindow = time.Hour * 12
+
+type dueSchedule struct {
+	schedule *models.Record
+	due      time.Time
+}
+
+// A schedule belongs to either a pod or a class (all the pods linked to it),
+// and runs either on a cron expression (in the local time of the app) or once,
+// at a given time.
+func validatePodSchedule(record *models.Record) error {
+	if (record.GetString("pod") == "") == (record.GetString("class") == "") {
+		return apis.NewBadRequestError("a schedule needs either a pod or a class", nil)
+	}
+
+	hasCron := record.GetString("cron") != ""
+	hasAt := !record.GetDateTime("at").IsZero()
+	if hasCron == hasAt {
+		return apis.NewBadRequestError("a schedule needs either a cron expression or a time", nil)
+	}
+
+	if hasCron {
+		if _, err := cron.NewSchedule(record.GetString("cron")); err != nil {
+			return apis.NewBadRequestError("invalid cron expression", err)
+		}
+	}
+
+	return nil
+}
+
+func makePodSchedulesBeforeCreateRequest() func(e *core.RecordCreateEvent) error {
+	return func(e *core.RecordCreateEvent) error {
+		// don't fire for times from before the schedule existed
+		e.Record.Set("lastRun", time.Now())
+
+		return validatePodSchedule(e.Record)
+	}
+}
+
+func makePodSchedulesBeforeUpdateRequest() func(e *core.RecordUpdateEvent) error {
+	return func(e *core.RecordUpdateEvent) error {
+		original := e.Record.OriginalCopy()
+
+		// only written by the scheduler
+		e.Record.Set("lastRun", original.GetDateTime("lastRun"))
+
+		// the update rule only checks the stored record, so a schedule can't be
+		// pointed at someone else's pod or class
+		e.Record.Set("pod", original.GetString("pod"))
+		e.Record.Set("class", original.GetString("class"))
+
+		return validatePodSchedule(e.Record)
+	}
+}
+
+// Checks the schedules every minute. The first check happens right away, and
+// catches up with whatever was missed while the app was down.
+func runPodScheduler(app *pocketbase.PocketBase, pm *pods.PodServerManager) {
+	for {
+		if err := runDueSchedules(app, pm, time.Now()); err != nil {
+			app.Logger().Error("failed to run pod schedules", "reason", err)
+		}
+
+		now := time.Now()
+		<-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+	}
+}
+
+func runDueSchedules(app *pocketbase.PocketBase, pm *pods.PodServerManager, now time.Time) error {
+	schedules, err := app.Dao().FindRecordsByFilter("podSchedules", "enabled=true", "", 0, 0)
+	if err != nil {
+		return err
+	}
+
+	var due []dueSchedule
+	for _, schedule := range schedules {
+		if t, ok := latestScheduleDue(schedule, now); ok {
+			due = append(due, dueSchedule{schedule: schedule, due: t})
+		}
+	}
+
+	// when both a start and a stop were missed, the last one wins
+	slices.SortFunc(due, func(a, b dueSchedule) int {
+		return a.due.Compare(b.due)
+	})
+
+	for _, d := range due {
+		runSchedule(app, pm, d, now)
+	}
+
+	return nil
+}
+
+// The latest time the schedule should have run at since it last did, if any.
+func latestScheduleDue(schedule *models.Record, now time.Time) (time.Time, bool) {
+	now = now.Local()
+
+	since := schedule.GetDateTime("lastRun").Time()
+	if oldest := now.Add(-missedScheduleWindow); since.Before(oldest) {
+		since = oldest
+	}
+
+	if at := schedule.GetDateTime("at"); !at.IsZero() {
+		t := at.Time()
+		return t, t.After(since) && !t.After(now)
+	}
+
+	expr, err := cron.NewSchedule(schedule.GetString("cron"))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	for t := now.Truncate(time.Minute); t.After(since); t = t.Add(-time.Minute) {
+		if expr.IsDue(cron.NewMoment(t)) {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+func runSchedule(app *pocketbase.PocketBase, pm *pods.PodServerManager, d dueSchedule, now time.Time) {
+	schedule := d.schedule
+	action := schedule.GetString("action")
+
+	var targets []*models.Record
+	var err error
+	if podId := schedule.GetString("pod"); podId != "" {
+		var pod *models.Record
+		pod, err = app.Dao().FindRecordById("pods", podId)
+		targets = []*models.Record{pod}
+	} else {
+		targets, err = app.Dao().FindRecordsByFilter(
+			"pods",
+			"class={:class}",
+			"name",
+			0,
+			0,
+			dbx.Params{"class": schedule.GetString("class")},
+		)
+	}
+
+	var results []classPodResult
+	if err == nil {
+		results = runOnClassPods(targets, func(pod *models.Record) (*rpc.ContainerInspectExtendedResult, error) {
+			err := runSchedulePodAction(app, pm, pod, action)
+			auditPodSystemAction(app, pod.Id, action, map[string]any{"schedule": schedule.Id}, err)
+
+			return nil, err
+		})
+
+		for _, r := range results {
+			if !r.Ok {
+				err = errors.New("failed for some pods")
+			}
+		}
+	}
+
+	schedule.Set("lastRun", d.due)
+	if err := app.Dao().SaveRecord(schedule); err != nil {
+		app.Logger().Error("failed to save pod schedule", "schedule", schedule.Id, "reason", err)
+	}
+
+	if err := logScheduleRun(app, schedule, d.due, now, results, err); err != nil {
+		app.Logger().Error("failed to log pod schedule run", "schedule", schedule.Id, "reason", err)
+	}
+}
+
+func runSchedulePodAction(app *pocketbase.PocketBase, pm *pods.PodServerManager, pod *models.Record, action string) error {
+	if err := checkPodNotMigrating(pod); err != nil {
+		return err
+	}
+
+	if action == scheduleStart {
+		if err := checkPodQuota(app, pod, time.Now()); err != nil {
+			return err
+		}
+
+		if pod.GetString("state") == podStateHibernated {
+			return wakePod(app, pm, pod.Id, true)
+		}
+	}
+
+	podId := pod.GetString("podId")
+	if podId == "" {
+		return errPodNotProvisioned
+	}
+
+	var err error
+	switch action {
+	case scheduleStart:
+		if err := resetPodCrashLoop(app, pm, pod); err != nil {
+			return err
+		}
+
+		err = pm.StartPodById(podId, defaultStartTimeout)
+	case scheduleStop:
+		err = pm.StopPodById(podId, defaultStartTimeout)
+	default:
+		return errors.New("invalid schedule action")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	getAndUpdatePodInspectDataLater(app, pm, pod.Id)
+
+	return nil
+}
+
+func logScheduleRun(
+	app *pocketbase.PocketBase,
+	schedule *models.Record,
+	due, now time.Time,
+	results []classPodResult,
+	runErr error,
+) error {
+	collection, err := app.Dao().FindCollectionByNameOrId("podScheduleRuns")
+	if err != nil {
+		return err
+	}
+
+	run := models.NewRecord(collection)
+	run.Set("schedule", schedule.Id)
+	run.Set("action", schedule.GetString("action"))
+	run.Set("scheduledFor", due)
+	// ran late, most likely because the app was down
+	run.Set("missed", now.Sub(due) >= time.Minute)
+	run.Set("ok", runErr == nil)
+	run.Set("results", results)
+	if runErr != nil {
+		run.Set("error", runErr.Error())
+	}
+
+	return app.Dao().SaveRecord(run)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Secrets are encrypted with the same key PocketBase uses for its settings,
+// from the env variable named by --encryptionEnv.
+var errSecretsKeyNotSet = errors.New("secrets encryption key is not set (needs 32 characters)")
+
+// The variables of the pod itself, set over the ones of its template.
+func podEnvFromRecord(pod *models.Record) (map[string]string, error) {
+	var env map[string]string
+	if err := unmarshalOptionalJSONField(pod, "env", &env); err != nil {
+		return nil, fmt.Errorf("invalid pod env: %w", err)
+	}
+
+	for name := range env {
+		if !envNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid pod env name %q", name)
+		}
+	}
+
+	return env, nil
+}
+
+func validatePodEnv(pod *models.Record) error {
+	if _, err := podEnvFromRecord(pod); err != nil {
+		return apis.NewBadRequestError("", err)
+	}
+
+	return nil
+}
+
+func secretsKey(app *pocketbase.PocketBase) (string, error) {
+	key := os.Getenv(app.EncryptionEnv())
+	if len(key) != 32 {
+		return "", errSecretsKeyNotSet
+	}
+
+	return key, nil
+}
+
+// The decrypted secrets of the template of the pod, then the ones of the pod
+// itself, which take precedence.
+func podSecretsEnv(app *pocketbase.PocketBase, pod *models.Record) (map[string]string, error) {
+	secrets, err := app.Dao().FindRecordsByFilter(
+		"podSecrets",
+		"pod={:pod} || (template!='' && template={:template})",
+		"",
+		0,
+		0,
+		dbx.Params{"pod": pod.Id, "template": pod.GetString("template")},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+
+	key, err := secretsKey(app)
+	if err != nil {
+		return nil, err
+	}
+
+	fromTemplate := map[string]string{}
+	fromPod := map[string]string{}
+	for _, secret := range secrets {
+		value, err := security.Decrypt(secret.GetString("value"), key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt secret %s: %w", secret.GetString("name"), err)
+		}
+
+		if secret.GetString("pod") != "" {
+			fromPod[secret.GetString("name")] = string(value)
+		} else {
+			fromTemplate[secret.GetString("name")] = string(value)
+		}
+	}
+
+	maps.Copy(fromTemplate, fromPod)
+
+	return fromTemplate, nil
+}
+
+func encryptSecretValue(app *pocketbase.PocketBase, record *models.Record) error {
+	key, err := secretsKey(app)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := security.Encrypt([]byte(record.GetString("value")), key)
+	if err != nil {
+		return err
+	}
+
+	record.Set("value", encrypted)
+
+	return nil
+}
+
+// A secret belongs to either a pod or a template. They only reach the pod
+// when its container is created, so changes apply on the next migration,
+// restore or wake.
+func makePodSecretsBeforeCreateRequest(app *pocketbase.PocketBase) func(e *core.RecordCreateEvent) error {
+	return func(e *core.RecordCreateEvent) error {
+		if (e.Record.GetString("pod") == "") == (e.Record.GetString("template") == "") {
+			return apis.NewBadRequestError("a secret needs either a pod or a template", nil)
+		}
+
+		if e.Record.GetString("value") == "" {
+			return apis.NewBadRequestError("missing value", nil)
+		}
+
+		return encryptSecretValue(app, e.Record)
+	}
+}
+
+// The value is never sent back, so it stays the same unless a new one is
+// given.
+func makePodSecretsBeforeUpdateRequest(app *pocketbase.PocketBase) func(e *core.RecordUpdateEvent) error {
+	return func(e *core.RecordUpdateEvent) error {
+		original := e.Record.OriginalCopy()
+
+		e.Record.Set("pod", original.GetString("pod"))
+		e.Record.Set("template", original.GetString("template"))
+
+		switch e.Record.GetString("value") {
+		case original.GetString("value"):
+			return nil
+		case "":
+			return apis.NewBadRequestError("missing value", nil)
+		default:
+			return encryptSecretValue(app, e.Record)
+		}
+	}
+}
+
+func hidePodSecretValues(secrets ...*models.Record) {
+	for _, secret := range secrets {
+		secret.Set("value", "")
+	}
+}
+
+func makePodSecretsAfterCreateRequest(app *pocketbase.PocketBase) func(e *core.RecordCreateEvent) error {
+	return func(e *core.RecordCreateEvent) error {
+		auditPodSecret(app, e.Record, "secretSet", e.HttpContext)
+		hidePodSecretValues(e.Record)
+
+		return nil
+	}
+}
+
+func makePodSecretsAfterUpdateRequest(app *pocketbase.PocketBase) func(e *core.RecordUpdateEvent) error {
+	return func(e *core.RecordUpdateEvent) error {
+		auditPodSecret(app, e.Record, "secretSet", e.HttpContext)
+		hidePodSecretValues(e.Record)
+
+		return nil
+	}
+}
+
+func makePodSecretsAfterDeleteRequest(app *pocketbase.PocketBase) func(e *core.RecordDeleteEvent) error {
+	return func(e *core.RecordDeleteEvent) error {
+		auditPodSecret(app, e.Record, "secretDelete", e.HttpContext)
+
+		return nil
+	}
+}
+
+// Only the name of the secret makes it to the audit log.
+func auditPodSecret(app *pocketbase.PocketBase, secret *models.Record, action string, c echo.Context) {
+	podId := secret.GetString("pod")
+	if podId == "" {
+		return
+	}
+
+	auditPod(app, podAuditEntry{
+		pod:    podId,
+		action: action,
+		params: map[string]any{"name": secret.GetString("name")},
+		time:   time.Now(),
+		c:      c,
+	})
+}
+
+func makePodSecretsViewRequest() func(e *core.RecordViewEvent) error {
+	return func(e *core.RecordViewEvent) error {
+		hidePodSecretValues(e.Record)
+
+		return nil
+	}
+}
+
+func makePodSecretsListRequest() func(e *core.RecordsListEvent) error {
+	return func(e *core.RecordsListEvent) error {
+		hidePodSecretValues(e.Records...)
+
+		return nil
+	}
+}
+
+// Realtime messages carry the whole record, encrypted value included.
+func makeRealtimeBeforeMessageSendHideSecrets() func(e *core.RealtimeMessageEvent) error {
+	return func(e *core.RealtimeMessageEvent) error {
+		var data map[string]any
+		if err := json.Unmarshal(e.Message.Data, &data); err != nil {
+			return nil
+		}
+
+		record, ok := data["record"].(map[string]any)
+		if !ok || record["collectionName"] != "podSecrets" {
+			return nil
+		}
+
+		record["value"] = ""
+
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+
+		e.Message.Data = encoded
+
+		return nil
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"noroom/pb/pods"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+const (
+	defaultSnapshotTimeout = time.Minute * 2
+	defaultMaxSnapshots    = 3
+)
+
+func makeApiNoroomPodSnapshotCreate(app *pocketbase.PocketBase, pm *pods.PodServerManager, validate *validator.Validate) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		type bodyModel struct {
+			Name string `json:"name" validate:"required"`
+		}
+
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		var body bodyModel
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+
+		if err := validate.Struct(body); err != nil {
+			return err
+		}
+
+		pod, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		if err := requirePodRole(app, info, pod, podRoleOperator); err != nil {
+			return err
+		}
+
+		if err := checkPodNotMigrating(pod); err != nil {
+			return apis.NewBadRequestError("", err)
+		}
+
+		// snapshots count towards the quota of the owner, whoever takes them
+		owner, err := app.Dao().FindRecordById("users", pod.GetString("owner"))
+		if err != nil {
+			return apis.NewBadRequestError("pod has no owner", err)
+		}
+
+		maxSnapshots := owner.GetInt("maxSnapshots")
+		if maxSnapshots <= 0 {
+			return apis.NewForbiddenError("snapshots are not enabled for the owner of the pod", nil)
+		}
+
+		snapshotsCollection, err := app.Dao().FindCollectionByNameOrId("podSnapshots")
+		if err != nil {
+			return err
+		}
+
+		// the record id doubles as the image tag, so generate it upfront
+		snapshot := models.NewRecord(snapshotsCollection)
+		snapshot.RefreshId()
+
+		podId := pod.GetString("podId")
+		image, err := pm.SnapshotPodById(podId, pod.Id, snapshot.Id, defaultSnapshotTimeout)
+		if err != nil {
+			return err
+		}
+
+		var size int64
+		snapshots, err := pm.ListSnapshotsOnServer(pod.GetString("server"), pod.Id)
+		if err != nil {
+			app.Logger().Error("failed to list snapshots after create", "pod", pod.Id, "reason", err)
+		}
+
+		for _, s := range snapshots {
+			if s.Tag == snapshot.Id {
+				size = s.Size
+			}
+		}
+
+		form := forms.NewRecordUpsert(app, snapshot)
+		form.LoadData(map[string]any{
+			"pod":   pod.Id,
+			"user":  owner.Id,
+			"name":  body.Name,
+			"image": image,
+			"size":  size,
+		})
+
+		if err := form.Submit(); err != nil {
+			if err := pm.DeleteSnapshotFromServer(pod.GetString("server"), image); err != nil {
+				app.Logger().Error("failed to delete snapshot without record", "image", image, "reason", err)
+			}
+
+			return err
+		}
+
+		if err := enforceSnapshotRetention(app, pm, owner.Id, maxSnapshots); err != nil {
+			app.Logger().Error("failed to enforce snapshot retention", "user", owner.Id, "reason", err)
+		}
+
+		return c.JSON(http.StatusOK, snapshot)
+	}
+}
+
+func makeApiNoroomPodSnapshotList(app *pocketbase.PocketBase) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		pod, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		if err := requirePodRole(app, info, pod, podRoleOperator); err != nil {
+			return err
+		}
+
+		snapshots, err := app.Dao().FindRecordsByFilter(
+			"podSnapshots",
+			"pod={:pod}",
+			"-created",
+			0,
+			0,
+			dbx.Params{"pod": pod.Id},
+		)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, snapshots)
+	}
+}
+
+func makeApiNoroomPodSnapshotRestore(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		snapshotId := c.PathParam("snapshot")
+		if id == "" || snapshotId == "" {
+			return apis.NewBadRequestError("missing id or snapshot", nil)
+		}
+
+		pod, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		if err := requirePodRole(app, info, pod, podRoleOwner); err != nil {
+			return err
+		}
+
+		snapshot, err := app.Dao().FindRecordById("podSnapshots", snapshotId)
+		if err != nil {
+			return err
+		}
+
+		if snapshot.GetString("pod") != pod.Id {
+			return apis.NewBadRequestError("snapshot does not belong to pod", nil)
+		}
+
+		if err := checkPodNotMigrating(pod); err != nil {
+			return apis.NewBadRequestError("", err)
+		}
+
+		podId := pod.GetString("podId")
+		newPodId, err := pm.RestorePodSnapshotById(podId, snapshot.GetString("image"), defaultSnapshotTimeout)
+		if err != nil {
+			return err
+		}
+
+		if err := app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+			pod, err := txDao.FindRecordById("pods", id)
+			if err != nil {
+				return err
+			}
+
+			pod.Set("podId", newPodId)
+
+			return txDao.SaveRecord(pod)
+		}); err != nil {
+			return err
+		}
+
+		getAndUpdatePodInspectDataLater(app, pm, id)
+
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+func makeApiNoroomPodSnapshotDelete(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		snapshotId := c.PathParam("snapshot")
+		if id == "" || snapshotId == "" {
+			return apis.NewBadRequestError("missing id or snapshot", nil)
+		}
+
+		pod, err := app.Dao().FindRecordById("pods", id)
+		if err != nil {
+			return err
+		}
+
+		if err := requirePodRole(app, info, pod, podRoleOwner); err != nil {
+			return err
+		}
+
+		snapshot, err := app.Dao().FindRecordById("podSnapshots", snapshotId)
+		if err != nil {
+			return err
+		}
+
+		if snapshot.GetString("pod") != pod.Id {
+			return apis.NewBadRequestError("snapshot does not belong to pod", nil)
+		}
+
+		if err := deleteSnapshot(app, pm, snapshot); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// Deletes the oldest snapshots of the user until at most max remain.
+func enforceSnapshotRetention(app *pocketbase.PocketBase, pm *pods.PodServerManager, userId string, max int) error {
+	snapshots, err := app.Dao().FindRecordsByFilter(
+		"podSnapshots",
+		"user={:user}",
+		"-created",
+		0,
+		0,
+		dbx.Params{"user": userId},
+	)
+	if err != nil {
+		return err
+	}
+
+	if len(snapshots) <= max {
+		return nil
+	}
+
+	for _, snapshot := range snapshots[max:] {
+		if err := deleteSnapshot(app, pm, snapshot); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func deleteSnapshot(app *pocketbase.PocketBase, pm *pods.PodServerManager, snapshot *models.Record) error {
+	pod, err := app.Dao().FindRecordById("pods", snapshot.GetString("pod"))
+	if err != nil {
+		return err
+	}
+
+	image := snapshot.GetString("image")
+	if err := pm.DeleteSnapshotFromServer(pod.GetString("server"), image); err != nil {
+		app.Logger().Error("failed to delete snapshot image", "image", image, "reason", err)
+	}
+
+	return app.Dao().DeleteRecord(snapshot)
+}
+
+// Removes every snapshot image of the pod from a pod server, and the records
+// pointing to them. A pod that moved to another server can't restore them,
+// and they would still count towards snapshot retention. The records of a
+// deleted pod are already gone with it.
+func deletePodSnapshots(app *pocketbase.PocketBase, pm *pods.PodServerManager, serverId, podRecordId string) {
+	snapshots, err := pm.ListSnapshotsOnServer(serverId, podRecordId)
+	if err != nil {
+		app.Logger().Error("failed to list pod snapshots", "pod", podRecordId, "reason", err)
+	}
+
+	for _, s := range snapshots {
+		if err := pm.DeleteSnapshotFromServer(serverId, s.Image); err != nil {
+			app.Logger().Error("failed to delete snapshot image", "image", s.Image, "reason", err)
+		}
+	}
+
+	records, err := app.Dao().FindRecordsByFilter(
+		"podSnapshots",
+		"pod={:pod}",
+		"",
+		0,
+		0,
+		dbx.Params{"pod": podRecordId},
+	)
+	if err != nil {
+		app.Logger().Error("failed to find pod snapshot records", "pod", podRecordId, "reason", err)
+		return
+	}
+
+	for _, record := range records {
+		if err := app.Dao().DeleteRecord(record); err != nil {
+			app.Logger().Error("failed to delete pod snapshot record", "snapshot", record.Id, "reason", err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"noroom/rpc"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+type templateFile struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+	Mode    int64  `json:"mode"`
+}
+
+// Builds the spec of a new pod from its template. Name, volume and restart
+// policy come from the pod itself.
+func podSpecFromTemplate(template *models.Record) (rpc.PodSpec, error) {
+	spec := rpc.PodSpec{
+		Image:       template.GetString("image"),
+		NetworkMode: template.GetString("networkMode"),
+	}
+
+	if err := unmarshalOptionalJSONField(template, "cmd", &spec.Cmd); err != nil {
+		return rpc.PodSpec{}, fmt.Errorf("invalid template cmd: %w", err)
+	}
+
+	if err := unmarshalOptionalJSONField(template, "env", &spec.Env); err != nil {
+		return rpc.PodSpec{}, fmt.Errorf("invalid template env: %w", err)
+	}
+
+	// the pod server only lets it tighten its own profile for the image
+	var security *rpc.SecurityProfile
+	if err := unmarshalOptionalJSONField(template, "security", &security); err != nil {
+		return rpc.PodSpec{}, fmt.Errorf("invalid template security profile: %w", err)
+	}
+
+	spec.Security = security
+
+	var files []templateFile
+	if err := unmarshalOptionalJSONField(template, "starterFiles", &files); err != nil {
+		return rpc.PodSpec{}, fmt.Errorf("invalid template starter files: %w", err)
+	}
+
+	for _, f := range files {
+		spec.Files = append(spec.Files, rpc.PodFile{
+			Path:    f.Path,
+			Content: []byte(f.Content),
+			Mode:    f.Mode,
+		})
+	}
+
+	// memory is in MiB, cpus may be fractional
+	limits := rpc.ResourceLimits{
+		Memory:    int64(template.GetInt("memory")) * 1024 * 1024,
+		NanoCPUs:  int64(template.GetFloat("cpus") * 1e9),
+		PidsLimit: int64(template.GetInt("pidsLimit")),
+	}
+
+	if limits != (rpc.ResourceLimits{}) {
+		spec.Limits = &limits
+	}
+
+	return spec, nil
+}
+
+// Templates without allowed roles or classes can be used by anyone. Students
+// belong to the classes they were present in.
+func canUseTemplate(app *pocketbase.PocketBase, user, template *models.Record) (bool, error) {
+	if user.GetString("role") == "editor" {
+		return true, nil
+	}
+
+	roles := template.GetStringSlice("allowedRoles")
+	classes := template.GetStringSlice("allowedClasses")
+	if len(roles) == 0 && len(classes) == 0 {
+		return true, nil
+	}
+
+	if slices.Contains(roles, user.GetString("role")) {
+		return true, nil
+	}
+
+	if len(classes) == 0 {
+		return false, nil
+	}
+
+	entries, err := app.Dao().FindRecordsByFilter(
+		"classPresenceEntries",
+		"user={:user}",
+		"",
+		0,
+		0,
+		dbx.Params{"user": user.Id},
+	)
+	if err != nil {
+		return false, err
+	}
+
+	for _, entry := range entries {
+		if slices.Contains(classes, entry.GetString("class")) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func unmarshalOptionalJSONField(record *models.Record, key string, result any) error {
+	raw := record.GetString(key)
+	if raw == "" || raw == "null" {
+		return nil
+	}
+
+	return json.Unmarshal([]byte(raw), result)
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"noroom/pb/pods"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const usageCheckInterval = time.Minute
+
+var errUsageQuotaExceeded = errors.New("usage quota exceeded")
+
+// Usage is kept as one podUsage record per run of a pod, opened when the
+// container starts and closed when it exits. The cpus and memory the pod was
+// given at the start are kept along with it, so resource-seconds can be
+// computed for runs that are still open.
+//
+// Usage belongs to the user the pod belongs to, and to the class of the pod,
+// so it is still counted after the pod is deleted.
+func openPodUsage(app *pocketbase.PocketBase, pod *models.Record, started time.Time) error {
+	// docker restarting a pod is a start without a stop by hand in between
+	if _, err := findOpenPodUsage(app, pod.Id); err == nil {
+		return nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId("podUsage")
+	if err != nil {
+		return err
+	}
+
+	// pods nobody has are still metered
+	user, err := findPodUser(app, pod)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	var cpus float64
+	var memory int
+	if templateId := pod.GetString("template"); templateId != "" {
+		template, err := app.Dao().FindRecordById("podTemplates", templateId)
+		if err != nil {
+			return err
+		}
+
+		cpus = template.GetFloat("cpus")
+		memory = template.GetInt("memory")
+	}
+
+	startedAt, err := types.ParseDateTime(started)
+	if err != nil {
+		return err
+	}
+
+	usage := models.NewRecord(collection)
+	usage.Set("pod", pod.Id)
+	usage.Set("user", user)
+	usage.Set("class", pod.GetString("class"))
+	usage.Set("started", startedAt)
+	usage.Set("cpus", cpus)
+	usage.Set("memory", memory)
+
+	return app.Dao().SaveRecord(usage)
+}
+
+func closePodUsage(app *pocketbase.PocketBase, podRecordId string, ended time.Time) error {
+	usage, err := findOpenPodUsage(app, podRecordId)
+	if errors.Is(err, sql.ErrNoRows) {
+		// started before metering, or while the app was down
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return endPodUsage(app, usage, ended)
+}
+
+func endPodUsage(app *pocketbase.PocketBase, usage *models.Record, ended time.Time) error {
+	endedAt, err := types.ParseDateTime(ended)
+	if err != nil {
+		return err
+	}
+
+	seconds := max(ended.Sub(usage.GetDateTime("started").Time()).Seconds(), 0)
+
+	usage.Set("ended", endedAt)
+	usage.Set("seconds", seconds)
+	usage.Set("cpuSeconds", seconds*usage.GetFloat("cpus"))
+	usage.Set("memorySeconds", seconds*usage.GetFloat("memory"))
+
+	return app.Dao().SaveRecord(usage)
+}
+
+func findOpenPodUsage(app *pocketbase.PocketBase, podRecordId string) (*models.Record, error) {
+	return app.Dao().FindFirstRecordByFilter(
+		"podUsage",
+		"pod={:pod} && ended=''",
+		dbx.Params{"pod": podRecordId},
+	)
+}
+
+// Pods without an owner are left from users that could not be migrated, see
+// checkAndMigratePodsToHaveOwners.
+func findPodUser(app *pocketbase.PocketBase, pod *models.Record) (string, error) {
+	if owner := pod.GetString("owner"); owner != "" {
+		return owner, nil
+	}
+
+	return "", sql.ErrNoRows
+}
+
+// Quotas are counted per week, starting on monday.
+func usageWeekStart(now time.Time) time.Time {
+	days := (int(now.Weekday()) + 6) % 7
+	y, m, d := now.AddDate(0, 0, -days).Date()
+
+	return time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+}
+
+type podUsageTotals struct {
+	Seconds       float64 `json:"seconds"`
+	CPUSeconds    float64 `json:"cpuSeconds"`
+	MemorySeconds float64 `json:"memorySeconds"`
+}
+
+func (t *podUsageTotals) add(usage *models.Record, since, now time.Time) {
+	started := usage.GetDateTime("started").Time()
+	ended := now
+	if !usage.GetDateTime("ended").IsZero() {
+		ended = usage.GetDateTime("ended").Time()
+	}
+
+	// only the part of the run since the start of the period counts
+	if started.Before(since) {
+		started = since
+	}
+
+	seconds := ended.Sub(started).Seconds()
+	if seconds <= 0 {
+		return
+	}
+
+	t.Seconds += seconds
+	t.CPUSeconds += seconds * usage.GetFloat("cpus")
+	t.MemorySeconds += seconds * usage.GetFloat("memory")
+}
+
+// The runs matching filter that overlap the period between since and now.
+func findPodUsage(app *pocketbase.PocketBase, filter string, params dbx.Params, since time.Time) ([]*models.Record, error) {
+	sinceAt, err := types.ParseDateTime(since)
+	if err != nil {
+		return nil, err
+	}
+
+	params["since"] = sinceAt.String()
+
+	return app.Dao().FindRecordsByFilter(
+		"podUsage",
+		"("+filter+") && (ended='' || ended>{:since})",
+		"started",
+		0,
+		0,
+		params,
+	)
+}
+
+func sumPodUsage(app *pocketbase.PocketBase, filter string, params dbx.Params, since, now time.Time) (podUsageTotals, error) {
+	runs, err := findPodUsage(app, filter, params, since)
+	if err != nil {
+		return podUsageTotals{}, err
+	}
+
+	var totals podUsageTotals
+	for _, usage := range runs {
+		totals.add(usage, since, now)
+	}
+
+	return totals, nil
+}
+
+// Checks the weekly hours of the user of the pod, and of its class. Class
+// quotas are per student, counting only the pods linked to the class.
+func checkPodQuota(app *pocketbase.PocketBase, pod *models.Record, now time.Time) error {
+	userId, err := findPodUser(app, pod)
+	if err != nil {
+		// nobody to charge
+		return nil
+	}
+
+	user, err := app.Dao().FindRecordById("users", userId)
+	if err != nil {
+		return err
+	}
+
+	since := usageWeekStart(now)
+
+	if hours := user.GetFloat("weeklyHours"); hours > 0 {
+		used, err := sumPodUsage(app, "user={:user}", dbx.Params{"user": userId}, since, now)
+		if err != nil {
+			return err
+		}
+
+		if used.Seconds >= hours*3600 {
+			return fmt.Errorf("%w: %.1f of %.1f weekly hours used", errUsageQuotaExceeded, used.Seconds/3600, hours)
+		}
+	}
+
+	classId := pod.GetString("class")
+	if classId == "" {
+		return nil
+	}
+
+	class, err := app.Dao().FindRecordById("classes", classId)
+	if err != nil {
+		return err
+	}
+
+	if hours := class.GetFloat("weeklyHours"); hours > 0 {
+		used, err := sumPodUsage(app, "user={:user} && class={:class}", dbx.Params{"user": userId, "class": classId}, since, now)
+		if err != nil {
+			return err
+		}
+
+		if used.Seconds >= hours*3600 {
+			return fmt.Errorf("%w: %.1f of %.1f weekly hours of the class used", errUsageQuotaExceeded, used.Seconds/3600, hours)
+		}
+	}
+
+	return nil
+}
+
+func watchPodUsage(app *pocketbase.PocketBase, pm *pods.PodServerManager, sm *pods.SessionManager) {
+	for range time.Tick(usageCheckInterval) {
+		if err := enforcePodQuotas(app, pm, sm); err != nil {
+			app.Logger().Error("failed to check pod usage", "reason", err)
+		}
+	}
+}
+
+// Events are lost while a pod server is unreachable or the app is down, so
+// runs are also opened and closed from what the pod records say. Running pods
+// over their quota are stopped.
+func enforcePodQuotas(app *pocketbase.PocketBase, pm *pods.PodServerManager, sm *pods.SessionManager) error {
+	now := time.Now()
+
+	open, err := app.Dao().FindRecordsByFilter("podUsage", "ended=''", "", 0, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, usage := range open {
+		pod, err := app.Dao().FindRecordById("pods", usage.GetString("pod"))
+		if err == nil && pod.GetBool("running") {
+			continue
+		}
+
+		// the pod is cleared from runs of deleted pods
+		if err := endPodUsage(app, usage, now); err != nil {
+			app.Logger().Error("failed to close pod usage", "usage", usage.Id, "reason", err)
+		}
+	}
+
+	running, err := app.Dao().FindRecordsByFilter("pods", "running=true && podId!=''", "", 0, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range running {
+		if err := openPodUsage(app, pod, now); err != nil {
+			app.Logger().Error("failed to open pod usage", "pod", pod.Id, "reason", err)
+		}
+
+		err := checkPodQuota(app, pod, now)
+		if !errors.Is(err, errUsageQuotaExceeded) {
+			if err != nil {
+				app.Logger().Error("failed to check pod quota", "pod", pod.Id, "reason", err)
+			}
+
+			continue
+		}
+
+		podId := pod.GetString("podId")
+		sm.Notify(podId, "this pod is being stopped, "+err.Error())
+
+		stopErr := pm.StopPodById(podId, defaultStartTimeout)
+		auditPodSystemAction(app, pod.Id, "stop", map[string]any{"reason": "quota", "quota": err.Error()}, stopErr)
+		if err := stopErr; err != nil {
+			app.Logger().Error("failed to stop pod over quota", "pod", pod.Id, "reason", err)
+			continue
+		}
+
+		app.Logger().Info("stopped pod over quota", "pod", pod.Id, "reason", err)
+		getAndUpdatePodInspectDataLater(app, pm, pod.Id)
+	}
+
+	return nil
+}
+
+type podUsageReport struct {
+	podUsageTotals
+	Pod  string `json:"pod"`
+	Name string `json:"name"`
+}
+
+type userUsageReport struct {
+	podUsageTotals
+	User        string           `json:"user"`
+	Since       time.Time        `json:"since"`
+	WeeklyHours float64          `json:"weeklyHours"`
+	Pods        []podUsageReport `json:"pods"`
+}
+
+// Usage of the current week, of the authenticated user. Editors may ask for
+// the usage of any user.
+func makeApiNoroomUsage(app *pocketbase.PocketBase) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		userId := info.AuthRecord.Id
+		if q := c.QueryParam("user"); q != "" && q != userId {
+			if info.AuthRecord.GetString("role") != "editor" {
+				return apis.NewForbiddenError("", nil)
+			}
+
+			userId = q
+		}
+
+		user, err := app.Dao().FindRecordById("users", userId)
+		if err != nil {
+			return apis.NewNotFoundError("", err)
+		}
+
+		now := time.Now()
+		since := usageWeekStart(now)
+
+		runs, err := findPodUsage(app, "user={:user}", dbx.Params{"user": user.Id}, since)
+		if err != nil {
+			return err
+		}
+
+		report := userUsageReport{
+			User:        user.Id,
+			Since:       since,
+			WeeklyHours: user.GetFloat("weeklyHours"),
+			Pods:        usageByPod(app, runs, since, now),
+		}
+
+		for _, usage := range runs {
+			report.add(usage, since, now)
+		}
+
+		return c.JSON(http.StatusOK, report)
+	}
+}
+
+type classUsageReport struct {
+	Class       string            `json:"class"`
+	Since       time.Time         `json:"since"`
+	WeeklyHours float64           `json:"weeklyHours"`
+	Students    []userUsageReport `json:"students"`
+}
+
+// Usage of the current week of the pods linked to the class, per student.
+// Only for the owner of the class and editors.
+func makeApiNoroomClassUsage(app *pocketbase.PocketBase) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		class, err := app.Dao().FindRecordById("classes", id)
+		if err != nil {
+			return err
+		}
+
+		if class.GetString("owner") != info.AuthRecord.Id && info.AuthRecord.GetString("role") != "editor" {
+			return apis.NewForbiddenError("", nil)
+		}
+
+		now := time.Now()
+		since := usageWeekStart(now)
+
+		runs, err := findPodUsage(app, "class={:class}", dbx.Params{"class": class.Id}, since)
+		if err != nil {
+			return err
+		}
+
+		byUser := map[string][]*models.Record{}
+		var users []string
+		for _, usage := range runs {
+			userId := usage.GetString("user")
+			if _, ok := byUser[userId]; !ok {
+				users = append(users, userId)
+			}
+
+			byUser[userId] = append(byUser[userId], usage)
+		}
+
+		report := classUsageReport{
+			Class:       class.Id,
+			Since:       since,
+			WeeklyHours: class.GetFloat("weeklyHours"),
+			Students:    []userUsageReport{},
+		}
+
+		for _, userId := range users {
+			student := userUsageReport{
+				User:        userId,
+				Since:       since,
+				WeeklyHours: class.GetFloat("weeklyHours"),
+				Pods:        usageByPod(app, byUser[userId], since, now),
+			}
+
+			for _, usage := range byUser[userId] {
+				student.add(usage, since, now)
+			}
+
+			report.Students = append(report.Students, student)
+		}
+
+		return c.JSON(http.StatusOK, report)
+	}
+}
+
+// Deleted pods keep their usage, without a name.
+func usageByPod(app *pocketbase.PocketBase, runs []*models.Record, since, now time.Time) []podUsageReport {
+	reports := []podUsageReport{}
+	index := map[string]int{}
+
+	for _, usage := range runs {
+		podId := usage.GetString("pod")
+
+		i, ok := index[podId]
+		if !ok {
+			report := podUsageReport{Pod: podId}
+			if pod, err := app.Dao().FindRecordById("pods", podId); err == nil {
+				report.Name = pod.GetString("name")
+			}
+
+			i = len(reports)
+			index[podId] = i
+			reports = append(reports, report)
+		}
+
+		reports[i].add(usage, since, now)
+	}
+
+	return reports
+}
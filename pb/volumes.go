@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"noroom/pb/pods"
+	"noroom/rpc"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+const (
+	homeVolumePrefix = "noroom-home-"
+)
+
+func makeApiNoroomVolumeList(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		if id == "" {
+			return apis.NewBadRequestError("missing id", nil)
+		}
+
+		server, err := app.Dao().FindRecordById("podServers", id)
+		if err != nil {
+			return err
+		}
+
+		volumes, err := pm.ListVolumesOnServer(server.Id)
+		if err != nil {
+			return err
+		}
+
+		visible := make([]rpc.VolumeInfo, 0, len(volumes))
+		for _, v := range volumes {
+			canAccess, err := canAccessVolume(app, info.AuthRecord, v.Name)
+			if err != nil {
+				return err
+			}
+
+			if canAccess {
+				visible = append(visible, v)
+			}
+		}
+
+		return c.JSON(http.StatusOK, visible)
+	}
+}
+
+func makeApiNoroomVolumeSize(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		name := c.PathParam("name")
+		if id == "" || name == "" {
+			return apis.NewBadRequestError("missing id or name", nil)
+		}
+
+		canAccess, err := canAccessVolume(app, info.AuthRecord, name)
+		if err != nil {
+			return err
+		}
+
+		if !canAccess {
+			return apis.NewForbiddenError("", nil)
+		}
+
+		server, err := app.Dao().FindRecordById("podServers", id)
+		if err != nil {
+			return err
+		}
+
+		size, err := pm.GetVolumeSizeOnServer(server.Id, name)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]any{"name": name, "size": size})
+	}
+}
+
+func makeApiNoroomVolumeBackup(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		name := c.PathParam("name")
+		if id == "" || name == "" {
+			return apis.NewBadRequestError("missing id or name", nil)
+		}
+
+		canAccess, err := canAccessVolume(app, info.AuthRecord, name)
+		if err != nil {
+			return err
+		}
+
+		if !canAccess {
+			return apis.NewForbiddenError("", nil)
+		}
+
+		server, err := app.Dao().FindRecordById("podServers", id)
+		if err != nil {
+			return err
+		}
+
+		archive, err := pm.BackupVolumeFromServer(server.Id, name)
+		if err != nil {
+			return err
+		}
+
+		defer archive.Close()
+
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name+".tar"))
+
+		return c.Stream(http.StatusOK, "application/x-tar", archive)
+	}
+}
+
+func makeApiNoroomVolumeDelete(app *pocketbase.PocketBase, pm *pods.PodServerManager) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		info := apis.RequestInfo(c)
+
+		id := c.PathParam("id")
+		name := c.PathParam("name")
+		if id == "" || name == "" {
+			return apis.NewBadRequestError("missing id or name", nil)
+		}
+
+		canAccess, err := canAccessVolume(app, info.AuthRecord, name)
+		if err != nil {
+			return err
+		}
+
+		if !canAccess {
+			return apis.NewForbiddenError("", nil)
+		}
+
+		server, err := app.Dao().FindRecordById("podServers", id)
+		if err != nil {
+			return err
+		}
+
+		inUse, err := isVolumeInUse(app, name)
+		if err != nil {
+			return err
+		}
+
+		if inUse {
+			return apis.NewBadRequestError("volume is in use by a pod", map[string]any{"volume": name})
+		}
+
+		if err := pm.DeleteVolumeFromServer(server.Id, name); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// Picks the home volume for a new pod. An empty request gets a fresh volume,
+// otherwise the requested volume (one kept from a deleted pod) is reattached
+// as long as it belongs to the user and no other pod is using it.
+//
+// Volumes live on the pod server, so reattaching only keeps the data when the
+// new pod is created on the same server as the old one.
+func resolvePodVolume(app *pocketbase.PocketBase, user *models.Record, requested string) (string, error) {
+	if requested == "" {
+		return newHomeVolumeName(user.Id), nil
+	}
+
+	canAccess, err := canAccessVolume(app, user, requested)
+	if err != nil {
+		return "", err
+	}
+
+	if !canAccess {
+		return "", apis.NewForbiddenError("can't attach a volume owned by another user", map[string]any{
+			"volume": requested,
+		})
+	}
+
+	inUse, err := isVolumeInUse(app, requested)
+	if err != nil {
+		return "", err
+	}
+
+	if inUse {
+		return "", apis.NewBadRequestError("volume is already in use by another pod", map[string]any{
+			"volume": requested,
+		})
+	}
+
+	return requested, nil
+}
+
+func isVolumeInUse(app *pocketbase.PocketBase, name string) (bool, error) {
+	pod, err := findPodUsingVolume(app, name)
+
+	return pod != nil, err
+}
+
+// Nil when no pod uses the volume.
+func findPodUsingVolume(app *pocketbase.PocketBase, name string) (*models.Record, error) {
+	pod, err := app.Dao().FindFirstRecordByFilter("pods", "volume={:volume}", dbx.Params{"volume": name})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return pod, err
+}
+
+// A volume in use belongs to the owner of its pod, which changes when the pod
+// is transferred. The name only tells who owns a volume kept from a deleted
+// pod.
+func canAccessVolume(app *pocketbase.PocketBase, user *models.Record, name string) (bool, error) {
+	if user.GetString("role") == "editor" {
+		return true, nil
+	}
+
+	pod, err := findPodUsingVolume(app, name)
+	if err != nil {
+		return false, err
+	}
+
+	if pod != nil {
+		return pod.GetString("owner") == user.Id, nil
+	}
+
+	return strings.HasPrefix(name, homeVolumePrefixForUser(user.Id)), nil
+}
+
+func homeVolumePrefixForUser(userId string) string {
+	return homeVolumePrefix + userId + "-"
+}
+
+func newHomeVolumeName(userId string) string {
+	return homeVolumePrefixForUser(userId) + security.RandomStringWithAlphabet(8, "abcdefghijklmnopqrstuvwxyz0123456789")
+}
@@ -3,23 +3,8 @@ package hub
 import (
 	"io"
 	"log"
-
-	"github.com/docker/docker/api/types"
 )
 
-type Bridge struct {
-	containerStream types.HijackedResponse
-}
-
-func (b *Bridge) Connect(stream io.ReadWriteCloser) {
-	go attachedContainerWritePump(b.containerStream.Conn, stream)
-	go attachedContainerReadPump(b.containerStream.Conn, stream)
-}
-
-func (b *Bridge) Close() {
-	b.containerStream.Close()
-}
-
 func attachedContainerWritePump(cont io.ReadCloser, bridge io.WriteCloser) {
 	defer bridge.Close()
 	defer cont.Close()
@@ -0,0 +1,78 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"noroom/rpc"
+	"strconv"
+
+	"github.com/docker/docker/api/types"
+)
+
+type forwardBridge struct {
+	conn net.Conn
+}
+
+func (b *forwardBridge) Connect(stream io.ReadWriteCloser) {
+	go attachedContainerWritePump(b.conn, stream)
+	go attachedContainerReadPump(b.conn, stream)
+}
+
+func (b *forwardBridge) Close() {
+	b.conn.Close()
+}
+
+func (h *Hub) Forward(ctx context.Context, id string, port int) (rpc.Bridge, error) {
+	log.Printf("Forward(id=%v, port=%v)", id, port)
+
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port: %d", port)
+	}
+
+	data, err := h.docker.ContainerInspect(ctx, id)
+	if err != nil {
+		log.Println("Forward err:", err)
+		return nil, err
+	}
+
+	if !data.State.Running {
+		return nil, fmt.Errorf("container %s is not running", id)
+	}
+
+	ip := containerIPAddress(data.NetworkSettings)
+	if ip == "" {
+		return nil, fmt.Errorf("container %s has no reachable address", id)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		log.Println("Forward err:", err)
+		return nil, err
+	}
+
+	return &forwardBridge{conn: conn}, nil
+}
+
+// Containers on the default bridge report the address at the top level, the
+// ones on user defined networks only have it per network.
+func containerIPAddress(settings *types.NetworkSettings) string {
+	if settings == nil {
+		return ""
+	}
+
+	if settings.IPAddress != "" {
+		return settings.IPAddress
+	}
+
+	for _, n := range settings.Networks {
+		if n != nil && n.IPAddress != "" {
+			return n.IPAddress
+		}
+	}
+
+	return ""
+}
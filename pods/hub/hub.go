@@ -2,46 +2,142 @@ package hub
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"noroom/rpc"
+	"sync"
 
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
 )
 
+const (
+	workingDir = "/home"
+
+	podKeyLabel = "noroom.pod"
+	// comma separated names of the variables that came from the secrets of the
+	// pod
+	podSecretsLabel = "noroom.secrets"
+)
+
+type Config struct {
+	Security SecurityConfig
+	// bytes of output kept per attached container
+	ScrollbackSize int
+}
+
 type Hub struct {
-	docker *client.Client
+	docker         *client.Client
+	security       SecurityConfig
+	scrollbackSize int
+
+	terminals      map[string]*terminal
+	terminalsMutex sync.Mutex
 }
 
-func NewHub(ctx context.Context) (*Hub, error) {
+func NewHub(ctx context.Context, config Config) (*Hub, error) {
+	if config.ScrollbackSize < 0 {
+		return nil, fmt.Errorf("invalid scrollback size: %d", config.ScrollbackSize)
+	}
+
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, err
 	}
 
 	return &Hub{
-		docker: docker,
+		docker:         docker,
+		security:       config.Security,
+		scrollbackSize: config.ScrollbackSize,
+		terminals:      map[string]*terminal{},
 	}, nil
 }
 
-func (h *Hub) Create(ctx context.Context, name, image string, cmd []string, env []string) (string, error) {
-	log.Printf("Create(name=%v, image=%v, cmd=%v, env=%v)", name, image, cmd, env)
+func (h *Hub) Create(ctx context.Context, spec rpc.PodSpec) (string, error) {
+	log.Printf("Create(name=%v, image=%v, volume=%v, cmd=%v)", spec.Name, spec.Image, spec.Volume, spec.Cmd)
+
+	if err := validatePodFiles(spec.Files); err != nil {
+		log.Println("Create err:", err)
+		return "", err
+	}
+
+	hostConfig := &container.HostConfig{
+		NetworkMode: container.NetworkMode(spec.NetworkMode),
+	}
+
+	if spec.Restart != nil {
+		policy, err := restartPolicyToDocker(*spec.Restart)
+		if err != nil {
+			log.Println("Create err:", err)
+			return "", err
+		}
 
-	resp, err := h.docker.ContainerCreate(ctx, &container.Config{
-		Cmd:          cmd,
-		Env:          env,
-		Image:        image,
-		WorkingDir:   "/home",
+		hostConfig.RestartPolicy = policy
+	}
+
+	// without a volume the files go to the container itself, which is always
+	// new
+	writeFiles := true
+	if spec.Volume != "" {
+		created, err := h.ensureHomeVolume(ctx, spec.Volume)
+		if err != nil {
+			log.Println("Create err:", err)
+			return "", err
+		}
+
+		writeFiles = created
+		hostConfig.Mounts = []mount.Mount{{
+			Type:   mount.TypeVolume,
+			Source: spec.Volume,
+			Target: workingDir,
+		}}
+	}
+
+	config := &container.Config{
+		Cmd:          spec.Cmd,
+		Env:          envFromMap(mergeEnv(spec.Env, spec.Secrets)),
+		Image:        spec.Image,
+		WorkingDir:   workingDir,
 		Tty:          true,
 		AttachStdin:  true,
 		AttachStdout: true,
 		AttachStderr: true,
 		OpenStdin:    true,
-	}, nil, nil, nil, name)
+		Labels:       podLabels(spec),
+	}
+
+	profile := h.security.profileFor(spec.Image, spec.Security)
+	if err := applySecurityProfile(config, hostConfig, profile); err != nil {
+		log.Println("Create err:", err)
+		return "", err
+	}
+
+	// after the profile, so the limits of a template take precedence as long
+	// as they are lower
+	if spec.Limits != nil {
+		applyResourceLimits(hostConfig, *spec.Limits, h.security.MaxLimits)
+	}
+
+	resp, err := h.docker.ContainerCreate(ctx, config, hostConfig, nil, nil, spec.Name)
 	if err != nil {
 		return "", err
 	}
 
+	if writeFiles && len(spec.Files) > 0 {
+		if err := h.writePodFiles(ctx, resp.ID, spec.Files); err != nil {
+			log.Println("Create err:", err)
+
+			// don't leave a half set up pod behind
+			if err := h.docker.ContainerRemove(context.Background(), resp.ID, container.RemoveOptions{}); err != nil {
+				log.Println("Create err:", err)
+			}
+
+			return "", err
+		}
+	}
+
 	return resp.ID, nil
 }
 
@@ -90,7 +186,31 @@ func (h *Hub) Delete(ctx context.Context, id string) error {
 	return nil
 }
 
-func (h *Hub) Inspect(ctx context.Context, id string) (*rpc.ContainerInspectResult, error) {
+func (h *Hub) Stats(ctx context.Context, id string) (*rpc.ContainerStats, error) {
+	log.Printf("Stats(id=%v)", id)
+
+	res, err := h.docker.ContainerStatsOneShot(ctx, id)
+	if err != nil {
+		log.Println("Stats err:", err)
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	var stats container.StatsResponse
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		log.Println("Stats err:", err)
+		return nil, err
+	}
+
+	return &rpc.ContainerStats{
+		CPUUsage:    stats.CPUStats.CPUUsage.TotalUsage,
+		MemoryUsage: stats.MemoryStats.Usage,
+		Read:        stats.Read,
+	}, nil
+}
+
+func (h *Hub) Inspect(ctx context.Context, id string) (*rpc.ContainerInspectExtendedResult, error) {
 	log.Printf("Inspect(id=%v)", id)
 
 	data, err := h.docker.ContainerInspect(ctx, id)
@@ -99,7 +219,7 @@ func (h *Hub) Inspect(ctx context.Context, id string) (*rpc.ContainerInspectResu
 		return nil, err
 	}
 
-	return &rpc.ContainerInspectResult{
+	result := rpc.ContainerInspectResult{
 		Id:         id,
 		Name:       data.Name,
 		Path:       data.Path,
@@ -121,19 +241,38 @@ func (h *Hub) Inspect(ctx context.Context, id string) (*rpc.ContainerInspectResu
 			StartedAt:  data.State.StartedAt,
 			FinishedAt: data.State.FinishedAt,
 		},
+		Security: containerSecurityFromDocker(data.Config, data.HostConfig),
+	}
+
+	return &rpc.ContainerInspectExtendedResult{
+		ContainerInspectResult: result,
+		Health:                 containerHealthFromDocker(data.State.Health),
+		RestartCount:           data.RestartCount,
+		Mounts:                 containerMountsFromDocker(data.Mounts),
+		Networks:               containerNetworksFromDocker(data.NetworkSettings),
+		Ports:                  containerPortsFromDocker(data.NetworkSettings),
+		Env:                    redactEnv(data.Config.Env, secretNames(data.Config.Labels)),
+		Resources:              containerResourcesFromDocker(data.HostConfig),
+		Labels:                 data.Config.Labels,
 	}, nil
 }
 
-func (h *Hub) Attach(ctx context.Context, id string) (rpc.Bridge, error) {
-	stream, err := h.docker.ContainerAttach(ctx, id, container.AttachOptions{
-		Stream: true,
-		Stdin:  true,
-		Stdout: true,
-		Stderr: true,
-	})
-	if err != nil {
-		return nil, err
+func (h *Hub) Ping(ctx context.Context) error {
+	if _, err := h.docker.Ping(ctx); err != nil {
+		log.Println("Ping err:", err)
+		return err
 	}
 
-	return &Bridge{containerStream: stream}, nil
+	return nil
+}
+
+func (h *Hub) Resize(ctx context.Context, id string, cols, rows uint) error {
+	log.Printf("Resize(id=%v, cols=%v, rows=%v)", id, cols, rows)
+
+	if err := h.docker.ContainerResize(ctx, id, container.ResizeOptions{Width: cols, Height: rows}); err != nil {
+		log.Println("Resize err:", err)
+		return err
+	}
+
+	return nil
 }
@@ -0,0 +1,144 @@
+package hub
+
+import (
+	"noroom/rpc"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// Environment variables that never hold anything sensitive, their values are
+// kept when inspecting.
+var safeEnvNames = []string{
+	"HOME",
+	"HOSTNAME",
+	"LANG",
+	"LC_ALL",
+	"PATH",
+	"PWD",
+	"SHELL",
+	"TERM",
+	"TZ",
+	"USER",
+}
+
+const redactedValue = "<redacted>"
+
+func containerHealthFromDocker(health *types.Health) *rpc.ContainerHealth {
+	if health == nil {
+		return nil
+	}
+
+	result := &rpc.ContainerHealth{
+		Status:        health.Status,
+		FailingStreak: health.FailingStreak,
+	}
+
+	if len(health.Log) > 0 {
+		last := health.Log[len(health.Log)-1]
+		result.LastExitCode = last.ExitCode
+		result.LastOutput = last.Output
+	}
+
+	return result
+}
+
+func containerMountsFromDocker(mounts []types.MountPoint) []rpc.ContainerMount {
+	result := make([]rpc.ContainerMount, 0, len(mounts))
+	for _, m := range mounts {
+		result = append(result, rpc.ContainerMount{
+			Type:        string(m.Type),
+			Name:        m.Name,
+			Source:      m.Source,
+			Destination: m.Destination,
+			RW:          m.RW,
+		})
+	}
+
+	return result
+}
+
+func containerNetworksFromDocker(settings *types.NetworkSettings) []rpc.ContainerNetwork {
+	if settings == nil {
+		return nil
+	}
+
+	result := make([]rpc.ContainerNetwork, 0, len(settings.Networks))
+	for name, network := range settings.Networks {
+		if network == nil {
+			continue
+		}
+
+		result = append(result, rpc.ContainerNetwork{
+			Name:       name,
+			IPAddress:  network.IPAddress,
+			Gateway:    network.Gateway,
+			MacAddress: network.MacAddress,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return result
+}
+
+func containerPortsFromDocker(settings *types.NetworkSettings) []rpc.ContainerPort {
+	if settings == nil {
+		return nil
+	}
+
+	result := []rpc.ContainerPort{}
+	for port, bindings := range settings.Ports {
+		// exposed, but not published
+		if len(bindings) == 0 {
+			result = append(result, rpc.ContainerPort{Port: string(port)})
+			continue
+		}
+
+		for _, b := range bindings {
+			result = append(result, rpc.ContainerPort{
+				Port:     string(port),
+				HostIP:   b.HostIP,
+				HostPort: b.HostPort,
+			})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Port < result[j].Port })
+
+	return result
+}
+
+func containerResourcesFromDocker(hostConfig *container.HostConfig) rpc.ContainerResources {
+	if hostConfig == nil {
+		return rpc.ContainerResources{}
+	}
+
+	return rpc.ContainerResources{
+		Memory:     hostConfig.Memory,
+		MemorySwap: hostConfig.MemorySwap,
+		NanoCPUs:   hostConfig.NanoCPUs,
+		CPUShares:  hostConfig.CPUShares,
+		PidsLimit:  hostConfig.PidsLimit,
+	}
+}
+
+// Keeps the names of the variables, but hides their values unless they are
+// known to be safe. Secrets are always hidden, whatever their name.
+func redactEnv(env []string, secrets []string) []string {
+	result := make([]string, 0, len(env))
+	for _, e := range env {
+		name, _, _ := strings.Cut(e, "=")
+		if slices.Contains(safeEnvNames, name) && !slices.Contains(secrets, name) {
+			result = append(result, e)
+			continue
+		}
+
+		result = append(result, name+"="+redactedValue)
+	}
+
+	return result
+}
@@ -0,0 +1,117 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"noroom/rpc"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+func (h *Hub) SetRestartPolicy(ctx context.Context, id string, policy rpc.RestartPolicy) error {
+	log.Printf("SetRestartPolicy(id=%v, policy=%v)", id, policy)
+
+	restart, err := restartPolicyToDocker(policy)
+	if err != nil {
+		log.Println("SetRestartPolicy err:", err)
+		return err
+	}
+
+	if _, err := h.docker.ContainerUpdate(ctx, id, container.UpdateConfig{
+		RestartPolicy: restart,
+	}); err != nil {
+		log.Println("SetRestartPolicy err:", err)
+		return err
+	}
+
+	return nil
+}
+
+// Follows the containers that start and exit. Docker does not say in the event
+// whether the container ran out of memory, so every container is inspected as
+// well.
+func (h *Hub) Events(ctx context.Context) (<-chan rpc.ContainerEvent, error) {
+	log.Printf("Events()")
+
+	msgs, errs := h.docker.Events(ctx, events.ListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", string(events.ContainerEventType)),
+			filters.Arg("event", string(events.ActionStart)),
+			filters.Arg("event", string(events.ActionDie)),
+		),
+	})
+
+	out := make(chan rpc.ContainerEvent)
+	go func() {
+		defer close(out)
+
+		for {
+			select {
+			case msg := <-msgs:
+				event := h.containerEventFromDocker(ctx, msg)
+
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					return
+				}
+			case err := <-errs:
+				if ctx.Err() == nil {
+					log.Println("Events err:", err)
+				}
+
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (h *Hub) containerEventFromDocker(ctx context.Context, msg events.Message) rpc.ContainerEvent {
+	event := rpc.ContainerEvent{
+		Id:     msg.Actor.ID,
+		Action: string(msg.Action),
+		Time:   time.Unix(0, msg.TimeNano),
+	}
+
+	if code, err := strconv.Atoi(msg.Actor.Attributes["exitCode"]); err == nil {
+		event.ExitCode = code
+	}
+
+	data, err := h.docker.ContainerInspect(ctx, msg.Actor.ID)
+	if err != nil {
+		// removed already, report what the event has
+		return event
+	}
+
+	event.OOMKilled = data.State.OOMKilled
+	event.RestartCount = data.RestartCount
+
+	return event
+}
+
+func restartPolicyToDocker(policy rpc.RestartPolicy) (container.RestartPolicy, error) {
+	mode := container.RestartPolicyMode(policy.Name)
+	switch mode {
+	case "":
+		mode = container.RestartPolicyDisabled
+	case container.RestartPolicyDisabled, container.RestartPolicyOnFailure, container.RestartPolicyAlways:
+	default:
+		return container.RestartPolicy{}, fmt.Errorf("invalid restart policy: %s", policy.Name)
+	}
+
+	result := container.RestartPolicy{Name: mode}
+	if mode == container.RestartPolicyOnFailure {
+		result.MaximumRetryCount = policy.MaximumRetryCount
+	}
+
+	return result, nil
+}
@@ -0,0 +1,206 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"noroom/rpc"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// Security profiles for the pods of this server. Images listed in Images
+// replace the default profile entirely. The profile carried by a create
+// request (from the template of the pod) can only make them stricter.
+type SecurityConfig struct {
+	Default rpc.SecurityProfile
+	Images  map[string]rpc.SecurityProfile
+	// the most a create request may ask for, 0 means no cap. The pids limit
+	// is capped by the profile instead.
+	MaxLimits rpc.ResourceLimits
+}
+
+func DefaultSecurityConfig() SecurityConfig {
+	return SecurityConfig{
+		Default: DefaultSecurityProfile(),
+		Images:  map[string]rpc.SecurityProfile{},
+	}
+}
+
+// Drops everything except what a shell and a package manager need to work
+// inside the container.
+func DefaultSecurityProfile() rpc.SecurityProfile {
+	return rpc.SecurityProfile{
+		CapDrop: []string{"ALL"},
+		CapAdd: []string{
+			"CHOWN",
+			"DAC_OVERRIDE",
+			"FOWNER",
+			"FSETID",
+			"SETGID",
+			"SETUID",
+			"KILL",
+			"NET_BIND_SERVICE",
+		},
+		NoNewPrivileges: true,
+		PidsLimit:       256,
+		Tmpfs: map[string]string{
+			"/tmp": "rw,nosuid,nodev,size=64m",
+		},
+	}
+}
+
+// Reads a JSON encoded SecurityConfig. Keys missing from the file keep their
+// defaults.
+func LoadSecurityConfig(path string) (SecurityConfig, error) {
+	cfg := DefaultSecurityConfig()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("failed to decode security config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+func (cfg *SecurityConfig) profileFor(image string, override *rpc.SecurityProfile) rpc.SecurityProfile {
+	base := cfg.Default
+	if p, ok := cfg.Images[image]; ok {
+		base = p
+	}
+
+	if override == nil {
+		return base
+	}
+
+	return restrictProfile(base, *override)
+}
+
+// The override can drop more capabilities, lower the pids limit, make the
+// rootfs read-only and add tmpfs mounts. It can't add back anything the base
+// profile takes away, and the seccomp profile always comes from the base.
+// Without a CapAdd of its own, the override keeps every capability the base
+// adds back, except the ones it drops.
+func restrictProfile(base, override rpc.SecurityProfile) rpc.SecurityProfile {
+	p := base
+
+	p.CapDrop = append(slices.Clone(base.CapDrop), override.CapDrop...)
+	p.CapAdd = nil
+	for _, c := range base.CapAdd {
+		if slices.Contains(override.CapDrop, c) {
+			continue
+		}
+
+		if len(override.CapAdd) > 0 && !slices.Contains(override.CapAdd, c) {
+			continue
+		}
+
+		p.CapAdd = append(p.CapAdd, c)
+	}
+
+	p.NoNewPrivileges = base.NoNewPrivileges || override.NoNewPrivileges
+	p.ReadonlyRootfs = base.ReadonlyRootfs || override.ReadonlyRootfs
+	p.PidsLimit = capLimit(override.PidsLimit, base.PidsLimit)
+
+	p.Tmpfs = maps.Clone(base.Tmpfs)
+	if p.Tmpfs == nil && len(override.Tmpfs) > 0 {
+		p.Tmpfs = map[string]string{}
+	}
+
+	for path, opts := range override.Tmpfs {
+		if _, ok := p.Tmpfs[path]; !ok {
+			p.Tmpfs[path] = opts
+		}
+	}
+
+	// running as a user of its choice could mean running as root
+	if base.User == "" {
+		p.User = override.User
+	}
+
+	return p
+}
+
+// The lower of the two, where 0 means unlimited.
+func capLimit(limit, max int64) int64 {
+	if max <= 0 {
+		return limit
+	}
+
+	if limit <= 0 || limit > max {
+		return max
+	}
+
+	return limit
+}
+
+func applySecurityProfile(config *container.Config, hostConfig *container.HostConfig, p rpc.SecurityProfile) error {
+	config.User = p.User
+
+	hostConfig.CapDrop = p.CapDrop
+	hostConfig.CapAdd = p.CapAdd
+	hostConfig.ReadonlyRootfs = p.ReadonlyRootfs
+	hostConfig.Tmpfs = p.Tmpfs
+
+	if p.PidsLimit != 0 {
+		limit := p.PidsLimit
+		hostConfig.PidsLimit = &limit
+	}
+
+	if p.NoNewPrivileges {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "no-new-privileges:true")
+	}
+
+	switch p.Seccomp {
+	case "":
+		// docker default profile
+	case "unconfined":
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp=unconfined")
+	default:
+		// the daemon expects the profile contents, not a path
+		profile, err := os.ReadFile(p.Seccomp)
+		if err != nil {
+			return fmt.Errorf("failed to read seccomp profile: %w", err)
+		}
+
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp="+string(profile))
+	}
+
+	return nil
+}
+
+func containerSecurityFromDocker(config *container.Config, hostConfig *container.HostConfig) rpc.ContainerSecurity {
+	var sec rpc.ContainerSecurity
+	if config != nil {
+		sec.User = config.User
+	}
+
+	if hostConfig != nil {
+		sec.Privileged = hostConfig.Privileged
+		sec.CapAdd = hostConfig.CapAdd
+		sec.CapDrop = hostConfig.CapDrop
+		sec.ReadonlyRootfs = hostConfig.ReadonlyRootfs
+		sec.Tmpfs = hostConfig.Tmpfs
+		sec.PidsLimit = hostConfig.PidsLimit
+
+		// seccomp profiles are huge, only report that one is set
+		for _, opt := range hostConfig.SecurityOpt {
+			if strings.HasPrefix(opt, "seccomp=") && opt != "seccomp=unconfined" {
+				opt = "seccomp=<custom>"
+			}
+
+			sec.SecurityOpt = append(sec.SecurityOpt, opt)
+		}
+	}
+
+	return sec
+}
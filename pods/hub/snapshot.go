@@ -0,0 +1,329 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"noroom/rpc"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+const (
+	snapshotRepository = "noroom-snapshots"
+	snapshotPodLabel   = "noroom.snapshot.pod"
+	snapshotTagLabel   = "noroom.snapshot.tag"
+)
+
+func (h *Hub) SnapshotCreate(ctx context.Context, id, pod, tag string) (string, error) {
+	log.Printf("SnapshotCreate(id=%v, pod=%v, tag=%v)", id, pod, tag)
+
+	data, err := h.docker.ContainerInspect(ctx, id)
+	if err != nil {
+		log.Println("SnapshotCreate err:", err)
+		return "", err
+	}
+
+	ref := fmt.Sprintf("%s/%s:%s", snapshotRepository, pod, tag)
+
+	// secrets are given to the pod again whenever its container is created,
+	// they never end up in an image
+	secrets := secretNames(data.Config.Labels)
+
+	config := *data.Config
+	config.Env = envWithout(data.Config.Env, secrets)
+	config.Labels = map[string]string{}
+	for k, v := range data.Config.Labels {
+		config.Labels[k] = v
+	}
+
+	delete(config.Labels, podSecretsLabel)
+	config.Labels[snapshotPodLabel] = pod
+	config.Labels[snapshotTagLabel] = tag
+
+	// commits never include volumes, so without a home volume the container
+	// has everything
+	if homeVolume(data.Mounts) == "" {
+		if _, err := h.docker.ContainerCommit(ctx, id, container.CommitOptions{
+			Reference: ref,
+			Pause:     true,
+			Config:    &config,
+		}); err != nil {
+			log.Println("SnapshotCreate err:", err)
+			return "", err
+		}
+
+		return ref, nil
+	}
+
+	// otherwise copy the home volume into a container made from the committed
+	// rootfs, and commit that one instead. The intermediate image is left
+	// untagged and gets pruned together with the snapshot.
+	baseConfig := *data.Config
+	baseConfig.Env = config.Env
+
+	base, err := h.docker.ContainerCommit(ctx, id, container.CommitOptions{
+		Pause:  true,
+		Config: &baseConfig,
+	})
+	if err != nil {
+		log.Println("SnapshotCreate err:", err)
+		return "", err
+	}
+
+	helper, err := h.docker.ContainerCreate(ctx, &container.Config{
+		Image: base.ID,
+		Cmd:   []string{"true"},
+	}, nil, nil, nil, "")
+	if err != nil {
+		log.Println("SnapshotCreate err:", err)
+		return "", err
+	}
+
+	defer h.removeVolumeHelper(helper.ID)
+
+	archive, _, err := h.docker.CopyFromContainer(ctx, id, workingDir)
+	if err != nil {
+		log.Println("SnapshotCreate err:", err)
+		return "", err
+	}
+
+	defer archive.Close()
+
+	// the archive entries are prefixed with the base name of the working dir
+	if err := h.docker.CopyToContainer(ctx, helper.ID, "/", archive, container.CopyToContainerOptions{
+		CopyUIDGID: true,
+	}); err != nil {
+		log.Println("SnapshotCreate err:", err)
+		return "", err
+	}
+
+	if _, err := h.docker.ContainerCommit(ctx, helper.ID, container.CommitOptions{
+		Reference: ref,
+		Config:    &config,
+	}); err != nil {
+		log.Println("SnapshotCreate err:", err)
+		return "", err
+	}
+
+	return ref, nil
+}
+
+func (h *Hub) SnapshotList(ctx context.Context, pod string) ([]rpc.SnapshotInfo, error) {
+	log.Printf("SnapshotList(pod=%v)", pod)
+
+	images, err := h.docker.ImageList(ctx, image.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", snapshotPodLabel+"="+pod)),
+	})
+	if err != nil {
+		log.Println("SnapshotList err:", err)
+		return nil, err
+	}
+
+	snapshots := make([]rpc.SnapshotInfo, 0, len(images))
+	for _, img := range images {
+		ref := img.ID
+		if len(img.RepoTags) > 0 {
+			ref = img.RepoTags[0]
+		}
+
+		snapshots = append(snapshots, rpc.SnapshotInfo{
+			Image:   ref,
+			Pod:     img.Labels[snapshotPodLabel],
+			Tag:     img.Labels[snapshotTagLabel],
+			Created: img.Created,
+			Size:    img.Size,
+		})
+	}
+
+	return snapshots, nil
+}
+
+// Replaces the container with a new one created from the snapshot, keeping
+// its name and host config. The home volume gets the contents saved in the
+// snapshot.
+//
+// The old container is only removed once the new one is ready, so a failed
+// restore can be retried. The home volume may be left half restored by then,
+// but the snapshot is untouched.
+func (h *Hub) SnapshotRestore(ctx context.Context, id, img string) (string, error) {
+	log.Printf("SnapshotRestore(id=%v, image=%v)", id, img)
+
+	if !strings.HasPrefix(img, snapshotRepository+"/") {
+		return "", fmt.Errorf("not a snapshot image: %s", img)
+	}
+
+	if _, _, err := h.docker.ImageInspectWithRaw(ctx, img); err != nil {
+		log.Println("SnapshotRestore err:", err)
+		return "", err
+	}
+
+	data, err := h.docker.ContainerInspect(ctx, id)
+	if err != nil {
+		log.Println("SnapshotRestore err:", err)
+		return "", err
+	}
+
+	config := *data.Config
+	config.Image = img
+	config.Hostname = ""
+
+	// nothing should write to the home volume while it is replaced
+	if err := h.docker.ContainerStop(ctx, id, container.StopOptions{}); err != nil {
+		log.Println("SnapshotRestore err:", err)
+		return "", err
+	}
+
+	name := strings.TrimPrefix(data.Name, "/")
+	resp, err := h.docker.ContainerCreate(ctx, &config, data.HostConfig, nil, nil, name+"-restoring")
+	if err != nil {
+		log.Println("SnapshotRestore err:", err)
+		return "", err
+	}
+
+	if volume := homeVolume(data.Mounts); volume != "" {
+		if err := h.restoreHomeFromImage(ctx, resp.ID, volume, img); err != nil {
+			log.Println("SnapshotRestore err:", err)
+			h.removeRestoringContainer(resp.ID)
+			return "", err
+		}
+	}
+
+	if err := h.docker.ContainerRemove(ctx, id, container.RemoveOptions{Force: true}); err != nil {
+		log.Println("SnapshotRestore err:", err)
+		h.removeRestoringContainer(resp.ID)
+		return "", err
+	}
+
+	// the old container is gone, so the new one is the pod now, whatever its
+	// name
+	if err := h.docker.ContainerRename(ctx, resp.ID, name); err != nil {
+		log.Println("SnapshotRestore failed to rename restored container:", err)
+	}
+
+	return resp.ID, nil
+}
+
+// The volume is still in use by the old container, so docker won't fill it
+// from the image. Empties it and copies the home of the snapshot in through
+// the new container instead.
+func (h *Hub) restoreHomeFromImage(ctx context.Context, id, volume, img string) error {
+	// without a volume mounted, the home of the container is the one saved
+	// in the image
+	source, err := h.docker.ContainerCreate(ctx, &container.Config{
+		Image: img,
+		Cmd:   []string{"true"},
+	}, nil, nil, nil, "")
+	if err != nil {
+		return err
+	}
+
+	defer h.removeVolumeHelper(source.ID)
+
+	if err := h.emptyVolume(ctx, volume); err != nil {
+		return err
+	}
+
+	archive, _, err := h.docker.CopyFromContainer(ctx, source.ID, workingDir)
+	if err != nil {
+		return err
+	}
+
+	defer archive.Close()
+
+	// the archive entries are prefixed with the base name of the working dir
+	return h.docker.CopyToContainer(ctx, id, "/", archive, container.CopyToContainerOptions{
+		CopyUIDGID: true,
+	})
+}
+
+func (h *Hub) removeRestoringContainer(id string) {
+	if err := h.docker.ContainerRemove(context.Background(), id, container.RemoveOptions{Force: true}); err != nil {
+		log.Println("failed to remove restoring container:", err)
+	}
+}
+
+func (h *Hub) SnapshotDelete(ctx context.Context, img string) error {
+	log.Printf("SnapshotDelete(image=%v)", img)
+
+	if !strings.HasPrefix(img, snapshotRepository+"/") {
+		return fmt.Errorf("not a snapshot image: %s", img)
+	}
+
+	if _, err := h.docker.ImageRemove(ctx, img, image.RemoveOptions{PruneChildren: true}); err != nil {
+		log.Println("SnapshotDelete err:", err)
+		return err
+	}
+
+	return nil
+}
+
+func homeVolume(mounts []types.MountPoint) string {
+	for _, m := range mounts {
+		if m.Type == mount.TypeVolume && m.Destination == workingDir {
+			return m.Name
+		}
+	}
+
+	return ""
+}
+
+func (h *Hub) SnapshotExport(ctx context.Context, img string) (io.ReadCloser, error) {
+	log.Printf("SnapshotExport(image=%v)", img)
+
+	archive, err := h.docker.ImageSave(ctx, []string{img})
+	if err != nil {
+		log.Println("SnapshotExport err:", err)
+		return nil, err
+	}
+
+	return archive, nil
+}
+
+func (h *Hub) SnapshotImport(ctx context.Context, archive io.Reader) error {
+	log.Printf("SnapshotImport()")
+
+	res, err := h.docker.ImageLoad(ctx, archive, true)
+	if err != nil {
+		log.Println("SnapshotImport err:", err)
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if err := readJSONMessages(res.Body); err != nil {
+		log.Println("SnapshotImport err:", err)
+		return err
+	}
+
+	return nil
+}
+
+// Failures halfway through loads and pulls only show up in the progress
+// messages.
+func readJSONMessages(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		if msg.Error != nil {
+			return msg.Error
+		}
+	}
+}
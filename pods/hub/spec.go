@@ -0,0 +1,144 @@
+package hub
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"noroom/rpc"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+const defaultPodFileMode = 0644
+
+func envFromMap(env map[string]string) []string {
+	result := make([]string, 0, len(env))
+	for k, v := range env {
+		result = append(result, k+"="+v)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// Later maps take precedence.
+func mergeEnv(envs ...map[string]string) map[string]string {
+	result := map[string]string{}
+	for _, env := range envs {
+		for k, v := range env {
+			result[k] = v
+		}
+	}
+
+	return result
+}
+
+func podLabels(spec rpc.PodSpec) map[string]string {
+	labels := map[string]string{podKeyLabel: spec.Key}
+	if len(spec.Secrets) == 0 {
+		return labels
+	}
+
+	names := make([]string, 0, len(spec.Secrets))
+	for name := range spec.Secrets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	labels[podSecretsLabel] = strings.Join(names, ",")
+
+	return labels
+}
+
+func secretNames(labels map[string]string) []string {
+	if labels[podSecretsLabel] == "" {
+		return nil
+	}
+
+	return strings.Split(labels[podSecretsLabel], ",")
+}
+
+// Drops the variables with the given names.
+func envWithout(env []string, names []string) []string {
+	result := make([]string, 0, len(env))
+	for _, e := range env {
+		name, _, _ := strings.Cut(e, "=")
+		if !slices.Contains(names, name) {
+			result = append(result, e)
+		}
+	}
+
+	return result
+}
+
+// Limits are capped by the ones of the server, and the pids limit by the
+// security profile already applied to the host config.
+func applyResourceLimits(hostConfig *container.HostConfig, limits, max rpc.ResourceLimits) {
+	if limits.Memory > 0 {
+		hostConfig.Memory = capLimit(limits.Memory, max.Memory)
+	}
+
+	if limits.NanoCPUs > 0 {
+		hostConfig.NanoCPUs = capLimit(limits.NanoCPUs, max.NanoCPUs)
+	}
+
+	if limits.PidsLimit > 0 {
+		var profileLimit int64
+		if hostConfig.PidsLimit != nil {
+			profileLimit = *hostConfig.PidsLimit
+		}
+
+		pids := capLimit(limits.PidsLimit, profileLimit)
+		hostConfig.PidsLimit = &pids
+	}
+}
+
+func validatePodFiles(files []rpc.PodFile) error {
+	for _, f := range files {
+		if !filepath.IsLocal(f.Path) {
+			return fmt.Errorf("invalid pod file path: %s", f.Path)
+		}
+	}
+
+	return nil
+}
+
+// Copies the files into the home directory of the container, which must not
+// be running yet.
+func (h *Hub) writePodFiles(ctx context.Context, id string, files []rpc.PodFile) error {
+	var buf bytes.Buffer
+
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		mode := f.Mode
+		if mode == 0 {
+			mode = defaultPodFileMode
+		}
+
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    filepath.ToSlash(filepath.Clean(f.Path)),
+			Mode:    mode,
+			Size:    int64(len(f.Content)),
+			ModTime: time.Now(),
+		}); err != nil {
+			return err
+		}
+
+		if _, err := tw.Write(f.Content); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return h.docker.CopyToContainer(ctx, id, workingDir, &buf, container.CopyToContainerOptions{})
+}
@@ -0,0 +1,289 @@
+package hub
+
+import (
+	"context"
+	"io"
+	"log"
+	"noroom/rpc"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+const (
+	DefaultScrollbackSize = 64 * 1024
+
+	// chunks of output queued for a client before it is considered too slow
+	// and disconnected
+	terminalClientQueueSize = 256
+)
+
+// Keeps the TTY of a container attached for as long as it runs, so the output
+// printed while no one is connected ends up in the scrollback and is replayed
+// to the next client.
+type terminal struct {
+	id   string
+	conn types.HijackedResponse
+
+	// guards the fields below, never held while writing to a client
+	mutex      sync.Mutex
+	scrollback *ringBuffer
+	clients    map[*terminalClient]struct{}
+	done       bool
+
+	hub *Hub
+}
+
+// Each client is written to from its own goroutine, so a slow one only holds
+// up itself.
+type terminalClient struct {
+	stream io.WriteCloser
+	queue  chan []byte
+}
+
+func newTerminalClient(stream io.WriteCloser) *terminalClient {
+	c := &terminalClient{
+		stream: stream,
+		queue:  make(chan []byte, terminalClientQueueSize),
+	}
+
+	go c.run()
+
+	return c
+}
+
+// Writes until the queue is closed or a write fails. The stream is closed
+// either way.
+func (c *terminalClient) run() {
+	defer c.stream.Close()
+
+	for data := range c.queue {
+		if _, err := c.stream.Write(data); err != nil {
+			log.Println("error writing to bridge:", err)
+
+			// keep draining, so the terminal never blocks on the queue
+			for range c.queue {
+			}
+
+			return
+		}
+	}
+}
+
+// Must be called with the terminal mutex held. Reports false when the client
+// fell too far behind.
+func (c *terminalClient) send(data []byte) bool {
+	select {
+	case c.queue <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *Hub) Attach(ctx context.Context, id string) (rpc.Bridge, error) {
+	log.Printf("Attach(id=%v)", id)
+
+	t, err := h.getTerminal(id)
+	if err != nil {
+		log.Println("Attach err:", err)
+		return nil, err
+	}
+
+	return &terminalBridge{terminal: t}, nil
+}
+
+func (h *Hub) getTerminal(id string) (*terminal, error) {
+	h.terminalsMutex.Lock()
+	defer h.terminalsMutex.Unlock()
+
+	if t, ok := h.terminals[id]; ok {
+		return t, nil
+	}
+
+	// the attach outlives the request, so it can't use its context
+	conn, err := h.docker.ContainerAttach(context.Background(), id, container.AttachOptions{
+		Stream: true,
+		Stdin:  true,
+		Stdout: true,
+		Stderr: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t := &terminal{
+		id:         id,
+		conn:       conn,
+		scrollback: newRingBuffer(h.scrollbackSize),
+		clients:    map[*terminalClient]struct{}{},
+		hub:        h,
+	}
+
+	h.terminals[id] = t
+	go t.pump()
+
+	return t, nil
+}
+
+func (t *terminal) pump() {
+	for {
+		buf := make([]byte, 512)
+		n, err := t.conn.Reader.Read(buf)
+		if err != nil {
+			log.Println("error reading from container:", err)
+			break
+		}
+
+		t.broadcast(buf[:n])
+	}
+
+	t.hub.terminalsMutex.Lock()
+	if t.hub.terminals[t.id] == t {
+		delete(t.hub.terminals, t.id)
+	}
+	t.hub.terminalsMutex.Unlock()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.done = true
+	t.conn.Close()
+
+	for client := range t.clients {
+		t.removeClient(client)
+	}
+}
+
+func (t *terminal) broadcast(data []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.scrollback.Write(data)
+
+	for client := range t.clients {
+		if !client.send(data) {
+			log.Println("bridge too slow, disconnecting it")
+			t.removeClient(client)
+		}
+	}
+}
+
+// Replays the scrollback and then keeps the client up to date. Queueing both
+// under the lock means no output is lost or sent twice in between.
+func (t *terminal) connect(stream io.WriteCloser) (*terminalClient, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.done {
+		return nil, false
+	}
+
+	client := newTerminalClient(stream)
+	client.send(t.scrollback.Bytes())
+	t.clients[client] = struct{}{}
+
+	return client, true
+}
+
+func (t *terminal) disconnect(client *terminalClient) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.removeClient(client)
+}
+
+// Must be called with the mutex held.
+func (t *terminal) removeClient(client *terminalClient) {
+	if _, ok := t.clients[client]; !ok {
+		return
+	}
+
+	delete(t.clients, client)
+	close(client.queue)
+}
+
+// ============================================================================
+
+type terminalBridge struct {
+	terminal *terminal
+}
+
+func (b *terminalBridge) Connect(stream io.ReadWriteCloser) {
+	client, ok := b.terminal.connect(stream)
+	if !ok {
+		stream.Close()
+		return
+	}
+
+	go func() {
+		// closes the stream once the queued output is written
+		defer b.terminal.disconnect(client)
+
+		for {
+			buf := make([]byte, 512)
+			n, err := stream.Read(buf)
+			if err != nil {
+				log.Println("error reading from bridge:", err)
+				return
+			}
+
+			if _, err := b.terminal.conn.Conn.Write(buf[:n]); err != nil {
+				log.Println("error writing to container:", err)
+				return
+			}
+		}
+	}()
+}
+
+// The container stays attached, only the bridge goes away.
+func (b *terminalBridge) Close() {}
+
+// ============================================================================
+
+// Fixed size buffer that keeps the last bytes written to it.
+type ringBuffer struct {
+	data []byte
+	// next write position
+	w int
+	// how much of data holds valid bytes
+	n int
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{data: make([]byte, size)}
+}
+
+func (r *ringBuffer) Write(p []byte) {
+	size := len(r.data)
+	if size == 0 {
+		return
+	}
+
+	if len(p) > size {
+		p = p[len(p)-size:]
+	}
+
+	copied := copy(r.data[r.w:], p)
+	copy(r.data, p[copied:])
+
+	r.w = (r.w + len(p)) % size
+	r.n = min(r.n+len(p), size)
+}
+
+func (r *ringBuffer) Bytes() []byte {
+	size := len(r.data)
+	out := make([]byte, 0, r.n)
+	if r.n == 0 {
+		return out
+	}
+
+	start := (r.w - r.n + size) % size
+	if start+r.n <= size {
+		return append(out, r.data[start:start+r.n]...)
+	}
+
+	out = append(out, r.data[start:]...)
+	return append(out, r.data[:r.w]...)
+}
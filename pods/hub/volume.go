@@ -0,0 +1,287 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"noroom/rpc"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/errdefs"
+)
+
+const (
+	// label set on every volume created by the hub, used to tell them apart
+	// from volumes not managed by noroom
+	volumeLabel = "noroom.volume"
+
+	// image used for the short-lived containers that give access to a volume
+	// for backups and restores, pulled when missing. Only started to empty a
+	// volume.
+	volumeHelperImage = "alpine"
+	volumeHelperPath  = "/volume"
+)
+
+func (h *Hub) VolumeList(ctx context.Context) ([]rpc.VolumeInfo, error) {
+	log.Printf("VolumeList()")
+
+	volumes, err := h.listHomeVolumes(ctx)
+	if err != nil {
+		log.Println("VolumeList err:", err)
+		return nil, err
+	}
+
+	infos := make([]rpc.VolumeInfo, 0, len(volumes))
+	for _, v := range volumes {
+		infos = append(infos, volumeInfoFromDocker(v))
+	}
+
+	return infos, nil
+}
+
+func (h *Hub) VolumeSize(ctx context.Context, name string) (int64, error) {
+	log.Printf("VolumeSize(name=%v)", name)
+
+	volumes, err := h.listHomeVolumes(ctx)
+	if err != nil {
+		log.Println("VolumeSize err:", err)
+		return 0, err
+	}
+
+	for _, v := range volumes {
+		if v.Name == name {
+			return volumeInfoFromDocker(v).Size, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no such volume: %s", name)
+}
+
+func (h *Hub) VolumeBackup(ctx context.Context, name string) (io.ReadCloser, error) {
+	log.Printf("VolumeBackup(name=%v)", name)
+
+	if _, err := h.docker.VolumeInspect(ctx, name); err != nil {
+		log.Println("VolumeBackup err:", err)
+		return nil, err
+	}
+
+	// docker can't export a volume directly, but it can copy out of a
+	// container that has it mounted, even if that container never runs
+	helper, err := h.createVolumeHelper(ctx, name, true, []string{"true"})
+	if err != nil {
+		log.Println("VolumeBackup err:", err)
+		return nil, err
+	}
+
+	archive, _, err := h.docker.CopyFromContainer(ctx, helper, volumeHelperPath+"/.")
+	if err != nil {
+		log.Println("VolumeBackup err:", err)
+		h.removeVolumeHelper(helper)
+		return nil, err
+	}
+
+	return &volumeArchive{ReadCloser: archive, hub: h, helperId: helper}, nil
+}
+
+func (h *Hub) VolumeRestore(ctx context.Context, name string, archive io.Reader) error {
+	log.Printf("VolumeRestore(name=%v)", name)
+
+	created, err := h.ensureHomeVolume(ctx, name)
+	if err != nil {
+		log.Println("VolumeRestore err:", err)
+		return err
+	}
+
+	if !created {
+		err := fmt.Errorf("volume already exists: %s", name)
+		log.Println("VolumeRestore err:", err)
+		return err
+	}
+
+	if err := h.restoreVolume(ctx, name, archive); err != nil {
+		log.Println("VolumeRestore err:", err)
+
+		// a half restored volume is worse than none
+		if err := h.docker.VolumeRemove(context.Background(), name, true); err != nil {
+			log.Println("VolumeRestore err:", err)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (h *Hub) restoreVolume(ctx context.Context, name string, archive io.Reader) error {
+	// same trick as backups, but the other way around
+	helper, err := h.createVolumeHelper(ctx, name, false, []string{"true"})
+	if err != nil {
+		return err
+	}
+
+	defer h.removeVolumeHelper(helper)
+
+	return h.docker.CopyToContainer(ctx, helper, volumeHelperPath, archive, container.CopyToContainerOptions{})
+}
+
+// Unlike the other helpers, this one has to run.
+func (h *Hub) emptyVolume(ctx context.Context, name string) error {
+	helper, err := h.createVolumeHelper(ctx, name, false, []string{"find", volumeHelperPath, "-mindepth", "1", "-delete"})
+	if err != nil {
+		return err
+	}
+
+	defer h.removeVolumeHelper(helper)
+
+	waitC, errC := h.docker.ContainerWait(ctx, helper, container.WaitConditionNextExit)
+	if err := h.docker.ContainerStart(ctx, helper, container.StartOptions{}); err != nil {
+		return err
+	}
+
+	select {
+	case res := <-waitC:
+		if res.StatusCode != 0 {
+			return fmt.Errorf("failed to empty volume %s: exit code %d", name, res.StatusCode)
+		}
+
+		return nil
+	case err := <-errC:
+		return err
+	}
+}
+
+func (h *Hub) VolumeDelete(ctx context.Context, name string, force bool) error {
+	log.Printf("VolumeDelete(name=%v, force=%v)", name, force)
+
+	if err := h.docker.VolumeRemove(ctx, name, force); err != nil {
+		log.Println("VolumeDelete err:", err)
+		return err
+	}
+
+	return nil
+}
+
+// Creating a volume that already exists is a no-op for docker, so this is
+// also what makes reattaching a kept volume to a new pod work.
+// Reports whether the volume had to be created.
+func (h *Hub) ensureHomeVolume(ctx context.Context, name string) (bool, error) {
+	if _, err := h.docker.VolumeInspect(ctx, name); err == nil {
+		return false, nil
+	} else if !errdefs.IsNotFound(err) {
+		return false, err
+	}
+
+	_, err := h.docker.VolumeCreate(ctx, volume.CreateOptions{
+		Name:   name,
+		Labels: map[string]string{volumeLabel: "home"},
+	})
+
+	return err == nil, err
+}
+
+// Volume sizes are only reported by the disk usage endpoint, so use that
+// instead of the volume list.
+func (h *Hub) listHomeVolumes(ctx context.Context) ([]*volume.Volume, error) {
+	usage, err := h.docker.DiskUsage(ctx, types.DiskUsageOptions{
+		Types: []types.DiskUsageObject{types.VolumeObject},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := make([]*volume.Volume, 0, len(usage.Volumes))
+	for _, v := range usage.Volumes {
+		if _, ok := v.Labels[volumeLabel]; ok {
+			volumes = append(volumes, v)
+		}
+	}
+
+	return volumes, nil
+}
+
+// Creates a container with the volume mounted at volumeHelperPath, pulling
+// the helper image first if the pod server doesn't have it.
+func (h *Hub) createVolumeHelper(ctx context.Context, name string, readOnly bool, cmd []string) (string, error) {
+	if err := h.ensureImage(ctx, volumeHelperImage); err != nil {
+		return "", err
+	}
+
+	helper, err := h.docker.ContainerCreate(ctx, &container.Config{
+		Image: volumeHelperImage,
+		Cmd:   cmd,
+	}, &container.HostConfig{
+		Mounts: []mount.Mount{{
+			Type:     mount.TypeVolume,
+			Source:   name,
+			Target:   volumeHelperPath,
+			ReadOnly: readOnly,
+		}},
+	}, nil, nil, "")
+	if err != nil {
+		return "", err
+	}
+
+	return helper.ID, nil
+}
+
+func (h *Hub) ensureImage(ctx context.Context, ref string) error {
+	if _, _, err := h.docker.ImageInspectWithRaw(ctx, ref); err == nil {
+		return nil
+	} else if !errdefs.IsNotFound(err) {
+		return err
+	}
+
+	res, err := h.docker.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return err
+	}
+
+	defer res.Close()
+
+	return readJSONMessages(res)
+}
+
+func (h *Hub) removeVolumeHelper(id string) {
+	if err := h.docker.ContainerRemove(context.Background(), id, container.RemoveOptions{}); err != nil {
+		log.Println("failed to remove volume helper container:", err)
+	}
+}
+
+func volumeInfoFromDocker(v *volume.Volume) rpc.VolumeInfo {
+	info := rpc.VolumeInfo{
+		Name:       v.Name,
+		Mountpoint: v.Mountpoint,
+		CreatedAt:  v.CreatedAt,
+		Labels:     v.Labels,
+		Size:       -1,
+		RefCount:   -1,
+	}
+
+	if v.UsageData != nil {
+		info.Size = v.UsageData.Size
+		info.RefCount = v.UsageData.RefCount
+	}
+
+	return info
+}
+
+// ============================================================================
+
+// removes the helper container once the archive is done with
+type volumeArchive struct {
+	io.ReadCloser
+	hub      *Hub
+	helperId string
+}
+
+func (a *volumeArchive) Close() error {
+	err := a.ReadCloser.Close()
+	a.hub.removeVolumeHelper(a.helperId)
+
+	return err
+}
@@ -10,9 +10,24 @@ import (
 
 func main() {
 	port := flag.Int("port", 6969, "port to use for listening")
+	securityConfigPath := flag.String("security-config", "", "JSON file with the container security profiles")
+	scrollback := flag.Int("scrollback", hub.DefaultScrollbackSize, "bytes of terminal output replayed to new attaches")
 	flag.Parse()
 
-	hub, err := hub.NewHub(context.Background())
+	security := hub.DefaultSecurityConfig()
+	if *securityConfigPath != "" {
+		cfg, err := hub.LoadSecurityConfig(*securityConfigPath)
+		if err != nil {
+			log.Fatal("failed to load security config:", err)
+		}
+
+		security = cfg
+	}
+
+	hub, err := hub.NewHub(context.Background(), hub.Config{
+		Security:       security,
+		ScrollbackSize: *scrollback,
+	})
 	if err != nil {
 		log.Fatal("failed to create hub:", err)
 	}
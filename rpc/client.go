@@ -17,8 +17,8 @@ func NewRpcClient(stream io.ReadWriter) *RpcClient {
 	}
 }
 
-func (rpc *RpcClient) Create(name, image string) (string, error) {
-	req, err := NewRpcCreateRequest(RpcCreateRequestParams{Name: name, Image: image})
+func (rpc *RpcClient) Create(spec PodSpec) (string, error) {
+	req, err := NewRpcCreateRequest(spec)
 	if err != nil {
 		return "", err
 	}
@@ -96,7 +96,7 @@ func (rpc *RpcClient) Delete(id string) error {
 	return nil
 }
 
-func (rpc *RpcClient) Inspect(id string) (*ContainerInspectResult, error) {
+func (rpc *RpcClient) Inspect(id string) (*ContainerInspectExtendedResult, error) {
 	req, err := NewRpcInspectRequest(RpcInspectRequestParams{Id: id})
 	if err != nil {
 		return nil, err
@@ -110,6 +110,20 @@ func (rpc *RpcClient) Inspect(id string) (*ContainerInspectResult, error) {
 	return res.Data, nil
 }
 
+func (rpc *RpcClient) Stats(id string) (*ContainerStats, error) {
+	req, err := NewRpcStatsRequest(RpcStatsRequestParams{Id: id})
+	if err != nil {
+		return nil, err
+	}
+
+	var res RpcStatsResponse
+	if err := sendMessage(rpc.stream, req, &res); err != nil {
+		return nil, err
+	}
+
+	return res.Data, nil
+}
+
 func (rpc *RpcClient) Attach(id string) error {
 	req, err := NewRpcAttachRequest(RpcInspectRequestParams{Id: id})
 	if err != nil {
@@ -127,26 +141,322 @@ func (rpc *RpcClient) Attach(id string) error {
 	return nil
 }
 
+func (rpc *RpcClient) Resize(id string, cols, rows uint) error {
+	req, err := NewRpcResizeRequest(RpcResizeRequestParams{Id: id, Cols: cols, Rows: rows})
+	if err != nil {
+		return err
+	}
+
+	var res RpcEmptyResponse
+	if err := sendMessage(rpc.stream, req, &res); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// After a successful call, the stream is bridged to the given TCP port inside
+// the container. Reads must go through the returned reader.
+func (rpc *RpcClient) Forward(id string, port int) (io.Reader, error) {
+	req, err := NewRpcForwardRequest(RpcForwardRequestParams{Id: id, Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	var res RpcEmptyResponse
+	buffered, err := sendMessageKeepBuffered(rpc.stream, req, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	// the decoder may have read past the response
+	conn := io.MultiReader(buffered, rpc.stream)
+
+	// we don't want to use this for RPC anymore
+	rpc.stream = nil
+
+	return conn, nil
+}
+
+func (rpc *RpcClient) SnapshotCreate(id, pod, tag string, timeout time.Duration) (string, error) {
+	req, err := NewRpcSnapshotCreateRequest(RpcSnapshotCreateRequestParams{
+		Id:      id,
+		Pod:     pod,
+		Tag:     tag,
+		Timeout: timeout,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var res RpcSnapshotCreateResponse
+	if err := sendMessage(rpc.stream, req, &res); err != nil {
+		return "", err
+	}
+
+	return res.Image, nil
+}
+
+func (rpc *RpcClient) SnapshotList(pod string) ([]SnapshotInfo, error) {
+	req, err := NewRpcSnapshotListRequest(RpcSnapshotListRequestParams{Pod: pod})
+	if err != nil {
+		return nil, err
+	}
+
+	var res RpcSnapshotListResponse
+	if err := sendMessage(rpc.stream, req, &res); err != nil {
+		return nil, err
+	}
+
+	return res.Data, nil
+}
+
+// Returns the id of the container that replaces the given one.
+func (rpc *RpcClient) SnapshotRestore(id, image string, timeout time.Duration) (string, error) {
+	req, err := NewRpcSnapshotRestoreRequest(RpcSnapshotRestoreRequestParams{
+		Id:      id,
+		Image:   image,
+		Timeout: timeout,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var res RpcSnapshotRestoreResponse
+	if err := sendMessage(rpc.stream, req, &res); err != nil {
+		return "", err
+	}
+
+	return res.Id, nil
+}
+
+func (rpc *RpcClient) SnapshotDelete(image string) error {
+	req, err := NewRpcSnapshotDeleteRequest(RpcSnapshotDeleteRequestParams{Image: image})
+	if err != nil {
+		return err
+	}
+
+	var res RpcEmptyResponse
+	if err := sendMessage(rpc.stream, req, &res); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (rpc *RpcClient) VolumeList() ([]VolumeInfo, error) {
+	req, err := NewRpcVolumeListRequest(RpcVolumeListRequestParams{})
+	if err != nil {
+		return nil, err
+	}
+
+	var res RpcVolumeListResponse
+	if err := sendMessage(rpc.stream, req, &res); err != nil {
+		return nil, err
+	}
+
+	return res.Data, nil
+}
+
+func (rpc *RpcClient) VolumeSize(name string) (int64, error) {
+	req, err := NewRpcVolumeSizeRequest(RpcVolumeSizeRequestParams{Name: name})
+	if err != nil {
+		return 0, err
+	}
+
+	var res RpcVolumeSizeResponse
+	if err := sendMessage(rpc.stream, req, &res); err != nil {
+		return 0, err
+	}
+
+	return res.Size, nil
+}
+
+// After a successful call, the returned reader yields the tar archive of the
+// volume. The server closes the stream once the archive ends.
+func (rpc *RpcClient) SetRestartPolicy(id string, policy RestartPolicy) error {
+	req, err := NewRpcSetRestartPolicyRequest(RpcSetRestartPolicyRequestParams{Id: id, Policy: policy})
+	if err != nil {
+		return err
+	}
+
+	var res RpcEmptyResponse
+	if err := sendMessage(rpc.stream, req, &res); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// The returned reader yields a ContainerEvent per JSON line, for as long as the
+// stream is open.
+func (rpc *RpcClient) Events() (io.Reader, error) {
+	req, err := NewRpcEventsRequest(RpcEventsRequestParams{})
+	if err != nil {
+		return nil, err
+	}
+
+	var res RpcEmptyResponse
+	buffered, err := sendMessageKeepBuffered(rpc.stream, req, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	events := io.MultiReader(buffered, rpc.stream)
+
+	// we don't want to use this for RPC anymore
+	rpc.stream = nil
+
+	return events, nil
+}
+
+func (rpc *RpcClient) VolumeBackup(name string) (io.Reader, error) {
+	req, err := NewRpcVolumeBackupRequest(RpcVolumeBackupRequestParams{Name: name})
+	if err != nil {
+		return nil, err
+	}
+
+	var res RpcEmptyResponse
+	buffered, err := sendMessageKeepBuffered(rpc.stream, req, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	// the decoder may have read past the response, so the start of the archive
+	// could be in its buffer
+	archive := io.MultiReader(buffered, rpc.stream)
+
+	// we don't want to use this for RPC anymore
+	rpc.stream = nil
+
+	return archive, nil
+}
+
+func (rpc *RpcClient) VolumeRestore(name string, archive io.Reader) error {
+	req, err := NewRpcVolumeRestoreRequest(RpcVolumeRestoreRequestParams{Name: name})
+	if err != nil {
+		return err
+	}
+
+	return rpc.upload(req, archive)
+}
+
+func (rpc *RpcClient) SnapshotExport(image string) (io.Reader, error) {
+	req, err := NewRpcSnapshotExportRequest(RpcSnapshotExportRequestParams{Image: image})
+	if err != nil {
+		return nil, err
+	}
+
+	var res RpcEmptyResponse
+	buffered, err := sendMessageKeepBuffered(rpc.stream, req, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := io.MultiReader(buffered, rpc.stream)
+
+	// we don't want to use this for RPC anymore
+	rpc.stream = nil
+
+	return archive, nil
+}
+
+func (rpc *RpcClient) SnapshotImport(archive io.Reader) error {
+	req, err := NewRpcSnapshotImportRequest(RpcSnapshotImportRequestParams{})
+	if err != nil {
+		return err
+	}
+
+	return rpc.upload(req, archive)
+}
+
+// Sends the archive once the server is ready for it, and waits for the server
+// to be done with it.
+func (rpc *RpcClient) upload(req RpcRequest, archive io.Reader) error {
+	stream := rpc.stream
+
+	// we don't want to use this for RPC anymore
+	rpc.stream = nil
+
+	var ready RpcEmptyResponse
+	if err := sendMessage(stream, req, &ready); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(stream, archive); err != nil {
+		return err
+	}
+
+	// closing only ends our side of the stream, which tells the server the
+	// archive is complete
+	if closer, ok := stream.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+
+	var res RpcEmptyResponse
+	if err := json.NewDecoder(stream).Decode(&res); err != nil {
+		return err
+	}
+
+	return res.GetErr()
+}
+
+func (rpc *RpcClient) VolumeDelete(name string, force bool) error {
+	req, err := NewRpcVolumeDeleteRequest(RpcVolumeDeleteRequestParams{Name: name, Force: force})
+	if err != nil {
+		return err
+	}
+
+	var res RpcEmptyResponse
+	if err := sendMessage(rpc.stream, req, &res); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 var (
 	ErrNilStream = errors.New("nil stream")
 )
 
+func (rpc *RpcClient) Ping() error {
+	req, err := NewRpcPingRequest(RpcPingRequestParams{})
+	if err != nil {
+		return err
+	}
+
+	var res RpcEmptyResponse
+	if err := sendMessage(rpc.stream, req, &res); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func sendMessage[R interface{ GetErr() error }](stream io.ReadWriter, req RpcRequest, res R) error {
+	_, err := sendMessageKeepBuffered(stream, req, res)
+	return err
+}
+
+func sendMessageKeepBuffered[R interface{ GetErr() error }](stream io.ReadWriter, req RpcRequest, res R) (io.Reader, error) {
 	if stream == nil {
-		return ErrNilStream
+		return nil, ErrNilStream
 	}
 
 	if err := json.NewEncoder(stream).Encode(req); err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := json.NewDecoder(stream).Decode(res); err != nil {
-		return err
+	dec := json.NewDecoder(stream)
+	if err := dec.Decode(res); err != nil {
+		return nil, err
 	}
 
 	if err := res.GetErr(); err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return dec.Buffered(), nil
 }
@@ -20,19 +20,77 @@ type RpcIdTimeoutRequestParams struct {
 	Timeout time.Duration
 }
 
-type RpcCreateRequestParams struct {
-	Name  string
+type RpcSetRestartPolicyRequestParams struct {
+	Id     string
+	Policy RestartPolicy
+}
+
+type RpcEventsRequestParams struct{}
+
+type RpcResizeRequestParams struct {
+	Id   string
+	Cols uint
+	Rows uint
+}
+
+type RpcForwardRequestParams struct {
+	Id   string
+	Port int
+}
+
+type RpcSnapshotCreateRequestParams struct {
+	Id string
+	// key used to find the snapshots of a pod again, container ids change
+	// when a snapshot is restored
+	Pod     string
+	Tag     string
+	Timeout time.Duration
+}
+
+type RpcSnapshotListRequestParams struct {
+	Pod string
+}
+
+type RpcSnapshotRestoreRequestParams struct {
+	Id      string
+	Image   string
+	Timeout time.Duration
+}
+
+type RpcSnapshotDeleteRequestParams struct {
+	Image string
+}
+
+type RpcSnapshotExportRequestParams struct {
 	Image string
-	Cmd   []string
-	Env   map[string]string
 }
 
+type RpcSnapshotImportRequestParams struct{}
+
+type RpcVolumeRequestParams struct {
+	Name string
+}
+
+type RpcVolumeDeleteRequestParams struct {
+	Name  string
+	Force bool
+}
+
+type RpcVolumeListRequestParams struct{}
+
+type RpcPingRequestParams struct{}
+
+type RpcCreateRequestParams = PodSpec
 type RpcStartRequestParams = RpcIdTimeoutRequestParams
 type RpcStopRequestParams = RpcIdTimeoutRequestParams
 type RpcKillRequestParams = RpcIdTimeoutRequestParams
 type RpcDeleteRequestParams = RpcIdRequestParams
 type RpcInspectRequestParams = RpcIdRequestParams
+type RpcStatsRequestParams = RpcIdRequestParams
 type RpcAttachRequestParams = RpcIdRequestParams
+type RpcVolumeSizeRequestParams = RpcVolumeRequestParams
+type RpcVolumeBackupRequestParams = RpcVolumeRequestParams
+type RpcVolumeRestoreRequestParams = RpcVolumeRequestParams
 
 func NewRpcCreateRequest(params RpcCreateRequestParams) (RpcRequest, error) {
 	return NewRpcRequest("create", params)
@@ -58,10 +116,78 @@ func NewRpcInspectRequest(params RpcInspectRequestParams) (RpcRequest, error) {
 	return NewRpcRequest("inspect", params)
 }
 
+func NewRpcStatsRequest(params RpcStatsRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("stats", params)
+}
+
 func NewRpcAttachRequest(params RpcAttachRequestParams) (RpcRequest, error) {
 	return NewRpcRequest("attach", params)
 }
 
+func NewRpcResizeRequest(params RpcResizeRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("resize", params)
+}
+
+func NewRpcSetRestartPolicyRequest(params RpcSetRestartPolicyRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("setRestartPolicy", params)
+}
+
+func NewRpcEventsRequest(params RpcEventsRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("events", params)
+}
+
+func NewRpcForwardRequest(params RpcForwardRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("forward", params)
+}
+
+func NewRpcSnapshotCreateRequest(params RpcSnapshotCreateRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("snapshotCreate", params)
+}
+
+func NewRpcSnapshotListRequest(params RpcSnapshotListRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("snapshotList", params)
+}
+
+func NewRpcSnapshotRestoreRequest(params RpcSnapshotRestoreRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("snapshotRestore", params)
+}
+
+func NewRpcSnapshotDeleteRequest(params RpcSnapshotDeleteRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("snapshotDelete", params)
+}
+
+func NewRpcSnapshotExportRequest(params RpcSnapshotExportRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("snapshotExport", params)
+}
+
+func NewRpcSnapshotImportRequest(params RpcSnapshotImportRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("snapshotImport", params)
+}
+
+func NewRpcVolumeListRequest(params RpcVolumeListRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("volumeList", params)
+}
+
+func NewRpcVolumeSizeRequest(params RpcVolumeSizeRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("volumeSize", params)
+}
+
+func NewRpcVolumeBackupRequest(params RpcVolumeBackupRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("volumeBackup", params)
+}
+
+func NewRpcVolumeRestoreRequest(params RpcVolumeRestoreRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("volumeRestore", params)
+}
+
+func NewRpcVolumeDeleteRequest(params RpcVolumeDeleteRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("volumeDelete", params)
+}
+
+func NewRpcPingRequest(params RpcPingRequestParams) (RpcRequest, error) {
+	return NewRpcRequest("ping", params)
+}
+
 func NewRpcRequest(method string, params any) (RpcRequest, error) {
 	rawParams, err := json.Marshal(params)
 	if err != nil {
@@ -99,9 +225,35 @@ type RpcIdResponse struct {
 
 type RpcInspectResponse struct {
 	RpcBaseResponse
-	Data *ContainerInspectResult
+	Data *ContainerInspectExtendedResult
+}
+
+type RpcStatsResponse struct {
+	RpcBaseResponse
+	Data *ContainerStats
+}
+
+type RpcSnapshotCreateResponse struct {
+	RpcBaseResponse
+	Image string
+}
+
+type RpcSnapshotListResponse struct {
+	RpcBaseResponse
+	Data []SnapshotInfo
+}
+
+type RpcVolumeListResponse struct {
+	RpcBaseResponse
+	Data []VolumeInfo
+}
+
+type RpcVolumeSizeResponse struct {
+	RpcBaseResponse
+	Size int64
 }
 
 type RpcEmptyResponse = RpcBaseResponse
 type RpcCreateResponse = RpcIdResponse
 type RpcKillResponse = RpcIdResponse
+type RpcSnapshotRestoreResponse = RpcIdResponse
@@ -22,6 +22,18 @@ type ContainerState struct {
 	FinishedAt string
 }
 
+// Effective security settings of a container, as reported by docker.
+type ContainerSecurity struct {
+	User           string
+	Privileged     bool
+	CapAdd         []string
+	CapDrop        []string
+	SecurityOpt    []string
+	ReadonlyRootfs bool
+	Tmpfs          map[string]string
+	PidsLimit      *int64
+}
+
 type ContainerInspectResult struct {
 	Id         string
 	Name       string
@@ -32,6 +44,168 @@ type ContainerInspectResult struct {
 	SizeRw     *int64
 	SizeRootFs *int64
 	State      ContainerState
+	Security   ContainerSecurity
+}
+
+type ContainerHealth struct {
+	Status        string
+	FailingStreak int
+	// of the last health check
+	LastExitCode int
+	LastOutput   string
+}
+
+type ContainerMount struct {
+	Type        string
+	Name        string
+	Source      string
+	Destination string
+	RW          bool
+}
+
+type ContainerNetwork struct {
+	Name       string
+	IPAddress  string
+	Gateway    string
+	MacAddress string
+}
+
+type ContainerPort struct {
+	// as in "80/tcp"
+	Port     string
+	HostIP   string
+	HostPort string
+}
+
+type ContainerResources struct {
+	Memory     int64
+	MemorySwap int64
+	NanoCPUs   int64
+	CPUShares  int64
+	PidsLimit  *int64
+}
+
+// A single sample of the resource usage of a container.
+type ContainerStats struct {
+	// total CPU time used since the container started, in nanoseconds
+	CPUUsage    uint64
+	MemoryUsage uint64
+	Read        time.Time
+}
+
+// Everything needed to diagnose a container without shell access to the pod
+// server.
+type ContainerInspectExtendedResult struct {
+	ContainerInspectResult
+	// nil when the image has no health check
+	Health       *ContainerHealth
+	RestartCount int
+	Mounts       []ContainerMount
+	Networks     []ContainerNetwork
+	Ports        []ContainerPort
+	// values are redacted, except for a few well known variables
+	Env       []string
+	Resources ContainerResources
+	Labels    map[string]string
+}
+
+// Hardening applied to a container when it is created.
+type SecurityProfile struct {
+	CapDrop         []string
+	CapAdd          []string
+	NoNewPrivileges bool
+	// 0 means unlimited
+	PidsLimit      int64
+	ReadonlyRootfs bool
+	// mounted as tmpfs, mostly useful with a read-only rootfs. Maps the path
+	// to the mount options
+	Tmpfs map[string]string
+	// empty runs as the image default
+	User string
+	// path to a seccomp profile on the pod server, "unconfined" to disable
+	// seccomp or empty for the docker default profile
+	Seccomp string
+}
+
+// Everything needed to create a pod.
+type PodSpec struct {
+	// stays the same for the lifetime of the pod (unlike its container id),
+	// so a container left behind by an interrupted create can be found again
+	Key    string
+	Name   string
+	Image  string
+	Volume string
+	// runs "sh" when empty
+	Cmd []string
+	Env map[string]string
+	// set over Env, their values are never shown when inspecting and are left
+	// out of snapshots
+	Secrets map[string]string
+	// nil uses the pod server's profile for the image, otherwise it can only
+	// make that profile stricter
+	Security *SecurityProfile
+	// nil never restarts
+	Restart *RestartPolicy
+	// nil keeps the docker defaults, and the limits of the security profile
+	Limits *ResourceLimits
+	// empty uses the docker default
+	NetworkMode string
+	// only written when the home volume is created along with the pod, so
+	// reused volumes are never overwritten
+	Files []PodFile
+}
+
+// Zero values keep the default.
+type ResourceLimits struct {
+	// in bytes
+	Memory int64
+	// in units of 1e-9 CPUs
+	NanoCPUs  int64
+	PidsLimit int64
+}
+
+type PodFile struct {
+	// relative to the home directory
+	Path    string
+	Content []byte
+	// defaults to 0644
+	Mode int64
+}
+
+// Same names as docker uses: "no", "on-failure" or "always".
+type RestartPolicy struct {
+	Name string
+	// only used by "on-failure", 0 retries forever
+	MaximumRetryCount int
+}
+
+// Sent whenever a container on the pod server exits.
+type ContainerEvent struct {
+	Id       string
+	Action   string
+	ExitCode int
+	// killed for running out of memory
+	OOMKilled    bool
+	RestartCount int
+	Time         time.Time
+}
+
+type VolumeInfo struct {
+	Name       string
+	Mountpoint string
+	CreatedAt  string
+	Labels     map[string]string
+	// -1 when the driver does not report it
+	Size     int64
+	RefCount int64
+}
+
+type SnapshotInfo struct {
+	Image   string
+	Pod     string
+	Tag     string
+	Created int64
+	Size    int64
 }
 
 type Bridge interface {
@@ -40,13 +214,35 @@ type Bridge interface {
 }
 
 type RpcHandler interface {
-	Create(ctx context.Context, name, image string, cmd []string, env []string) (string, error)
+	Create(ctx context.Context, spec PodSpec) (string, error)
 	Start(ctx context.Context, id string) error
 	Stop(ctx context.Context, id string) error
 	Kill(ctx context.Context, id, signal string) error
 	Delete(ctx context.Context, id string) error
-	Inspect(ctx context.Context, id string) (*ContainerInspectResult, error)
+	Inspect(ctx context.Context, id string) (*ContainerInspectExtendedResult, error)
+	Stats(ctx context.Context, id string) (*ContainerStats, error)
 	Attach(ctx context.Context, id string) (Bridge, error)
+	Resize(ctx context.Context, id string, cols, rows uint) error
+	SetRestartPolicy(ctx context.Context, id string, policy RestartPolicy) error
+	// the channel is closed once ctx is done
+	Events(ctx context.Context) (<-chan ContainerEvent, error)
+	Forward(ctx context.Context, id string, port int) (Bridge, error)
+	SnapshotCreate(ctx context.Context, id, pod, tag string) (string, error)
+	SnapshotList(ctx context.Context, pod string) ([]SnapshotInfo, error)
+	SnapshotRestore(ctx context.Context, id, image string) (string, error)
+	SnapshotDelete(ctx context.Context, image string) error
+	// the archive holds the image with its tags, as made by docker save
+	SnapshotExport(ctx context.Context, image string) (io.ReadCloser, error)
+	SnapshotImport(ctx context.Context, archive io.Reader) error
+	VolumeList(ctx context.Context) ([]VolumeInfo, error)
+	VolumeSize(ctx context.Context, name string) (int64, error)
+	VolumeBackup(ctx context.Context, name string) (io.ReadCloser, error)
+	// creates the volume from an archive made by VolumeBackup. The volume must
+	// not exist yet.
+	VolumeRestore(ctx context.Context, name string, archive io.Reader) error
+	VolumeDelete(ctx context.Context, name string, force bool) error
+	// checks that the pod server can reach docker
+	Ping(ctx context.Context) error
 }
 
 type RpcServer struct {
@@ -83,8 +279,42 @@ func (rpc *RpcServer) HandleOne(ctx context.Context) (bool, error) {
 		return false, rpc.methodDelete(ctx, req.Params)
 	case "inspect":
 		return false, rpc.methodInspect(ctx, req.Params)
+	case "stats":
+		return false, rpc.methodStats(ctx, req.Params)
 	case "attach":
 		return true, rpc.methodAttach(ctx, req.Params)
+	case "resize":
+		return false, rpc.methodResize(ctx, req.Params)
+	case "setRestartPolicy":
+		return false, rpc.methodSetRestartPolicy(ctx, req.Params)
+	case "events":
+		return true, rpc.methodEvents(ctx, req.Params)
+	case "forward":
+		return true, rpc.methodForward(ctx, req.Params)
+	case "snapshotCreate":
+		return false, rpc.methodSnapshotCreate(ctx, req.Params)
+	case "snapshotList":
+		return false, rpc.methodSnapshotList(ctx, req.Params)
+	case "snapshotRestore":
+		return false, rpc.methodSnapshotRestore(ctx, req.Params)
+	case "snapshotDelete":
+		return false, rpc.methodSnapshotDelete(ctx, req.Params)
+	case "volumeList":
+		return false, rpc.methodVolumeList(ctx, req.Params)
+	case "volumeSize":
+		return false, rpc.methodVolumeSize(ctx, req.Params)
+	case "volumeBackup":
+		return true, rpc.methodVolumeBackup(ctx, req.Params)
+	case "volumeRestore":
+		return true, rpc.methodVolumeRestore(ctx, req.Params)
+	case "snapshotExport":
+		return true, rpc.methodSnapshotExport(ctx, req.Params)
+	case "snapshotImport":
+		return true, rpc.methodSnapshotImport(ctx, req.Params)
+	case "volumeDelete":
+		return false, rpc.methodVolumeDelete(ctx, req.Params)
+	case "ping":
+		return false, rpc.methodPing(ctx, req.Params)
 	default:
 		return false, fmt.Errorf("invalid method: %s", req.Method)
 	}
@@ -96,20 +326,14 @@ func (rpc *RpcServer) methodCreate(ctx context.Context, rawParams json.RawMessag
 		return err
 	}
 
-	env := make([]string, 0, len(params.Env))
-	for k, v := range params.Env {
-		env = append(env, fmt.Sprintf(`%s="%s"`, k, v))
-	}
-
-	cmd := []string{"sh"}
-	if len(params.Cmd) > 0 {
-		cmd = params.Cmd
+	if len(params.Cmd) == 0 {
+		params.Cmd = []string{"sh"}
 	}
 
 	ctx, cancel := context.WithTimeout(ctx, rpc.timeout)
 	defer cancel()
 
-	id, err := rpc.handler.Create(ctx, params.Name, params.Image, cmd, env)
+	id, err := rpc.handler.Create(ctx, params)
 	if err != nil {
 		return rpc.sendResponse(NewRpcError(err))
 	}
@@ -213,6 +437,23 @@ func (rpc *RpcServer) methodInspect(ctx context.Context, rawParams json.RawMessa
 	return rpc.sendResponse(RpcInspectResponse{Data: data})
 }
 
+func (rpc *RpcServer) methodStats(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcStatsRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rpc.timeout)
+	defer cancel()
+
+	data, err := rpc.handler.Stats(ctx, params.Id)
+	if err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	return rpc.sendResponse(RpcStatsResponse{Data: data})
+}
+
 func (rpc *RpcServer) methodAttach(ctx context.Context, rawParams json.RawMessage) error {
 	var params RpcIdRequestParams
 	if err := json.Unmarshal(rawParams, &params); err != nil {
@@ -238,6 +479,332 @@ func (rpc *RpcServer) methodAttach(ctx context.Context, rawParams json.RawMessag
 	return nil
 }
 
+func (rpc *RpcServer) methodResize(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcResizeRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rpc.timeout)
+	defer cancel()
+
+	if err := rpc.handler.Resize(ctx, params.Id, params.Cols, params.Rows); err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	return rpc.sendResponse(RpcEmptyResponse{})
+}
+
+func (rpc *RpcServer) methodSetRestartPolicy(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcSetRestartPolicyRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rpc.timeout)
+	defer cancel()
+
+	if err := rpc.handler.SetRestartPolicy(ctx, params.Id, params.Policy); err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	return rpc.sendResponse(RpcEmptyResponse{})
+}
+
+// Streams events as JSON lines until the client goes away. The stream is
+// consumed by this method either way.
+func (rpc *RpcServer) methodEvents(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcEventsRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	defer rpc.stream.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events, err := rpc.handler.Events(ctx)
+	if err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	if err := rpc.sendResponse(RpcEmptyResponse{}); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(rpc.stream)
+	for event := range events {
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (rpc *RpcServer) methodForward(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcForwardRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rpc.timeout)
+	defer cancel()
+
+	bridge, err := rpc.handler.Forward(ctx, params.Id, params.Port)
+	if err != nil {
+		// the stream is detached either way, don't leak it
+		defer rpc.stream.Close()
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	if err := rpc.sendResponse(RpcEmptyResponse{}); err != nil {
+		bridge.Close()
+
+		return err
+	}
+
+	bridge.Connect(rpc.stream)
+
+	return nil
+}
+
+func (rpc *RpcServer) methodSnapshotCreate(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcSnapshotCreateRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	timeout := rpc.timeout
+	if params.Timeout.Nanoseconds() != 0 {
+		timeout = params.Timeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	image, err := rpc.handler.SnapshotCreate(ctx, params.Id, params.Pod, params.Tag)
+	if err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	return rpc.sendResponse(RpcSnapshotCreateResponse{Image: image})
+}
+
+func (rpc *RpcServer) methodSnapshotList(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcSnapshotListRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rpc.timeout)
+	defer cancel()
+
+	data, err := rpc.handler.SnapshotList(ctx, params.Pod)
+	if err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	return rpc.sendResponse(RpcSnapshotListResponse{Data: data})
+}
+
+func (rpc *RpcServer) methodSnapshotRestore(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcSnapshotRestoreRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	timeout := rpc.timeout
+	if params.Timeout.Nanoseconds() != 0 {
+		timeout = params.Timeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	id, err := rpc.handler.SnapshotRestore(ctx, params.Id, params.Image)
+	if err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	return rpc.sendResponse(RpcSnapshotRestoreResponse{Id: id})
+}
+
+func (rpc *RpcServer) methodSnapshotDelete(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcSnapshotDeleteRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rpc.timeout)
+	defer cancel()
+
+	if err := rpc.handler.SnapshotDelete(ctx, params.Image); err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	return rpc.sendResponse(RpcEmptyResponse{})
+}
+
+func (rpc *RpcServer) methodVolumeList(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcVolumeListRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rpc.timeout)
+	defer cancel()
+
+	data, err := rpc.handler.VolumeList(ctx)
+	if err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	return rpc.sendResponse(RpcVolumeListResponse{Data: data})
+}
+
+func (rpc *RpcServer) methodVolumeSize(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcVolumeSizeRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rpc.timeout)
+	defer cancel()
+
+	size, err := rpc.handler.VolumeSize(ctx, params.Name)
+	if err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	return rpc.sendResponse(RpcVolumeSizeResponse{Size: size})
+}
+
+func (rpc *RpcServer) methodVolumeBackup(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcVolumeBackupRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	// no timeout here, the archive may take a while to stream. The stream is
+	// consumed by this method either way.
+	defer rpc.stream.Close()
+
+	archive, err := rpc.handler.VolumeBackup(ctx, params.Name)
+	if err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	defer archive.Close()
+
+	if err := rpc.sendResponse(RpcEmptyResponse{}); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(rpc.stream, archive)
+	return err
+}
+
+// The client only sends the archive once it gets the first response, and ends
+// it by closing its side of the stream. The second response tells how the
+// restore went.
+func (rpc *RpcServer) methodVolumeRestore(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcVolumeRestoreRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	// no timeout here either, for the same reason as backups
+	defer rpc.stream.Close()
+
+	if err := rpc.sendResponse(RpcEmptyResponse{}); err != nil {
+		return err
+	}
+
+	if err := rpc.handler.VolumeRestore(ctx, params.Name, rpc.stream); err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	return rpc.sendResponse(RpcEmptyResponse{})
+}
+
+func (rpc *RpcServer) methodSnapshotExport(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcSnapshotExportRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	// same as volume backups
+	defer rpc.stream.Close()
+
+	archive, err := rpc.handler.SnapshotExport(ctx, params.Image)
+	if err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	defer archive.Close()
+
+	if err := rpc.sendResponse(RpcEmptyResponse{}); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(rpc.stream, archive)
+	return err
+}
+
+// Same protocol as methodVolumeRestore.
+func (rpc *RpcServer) methodSnapshotImport(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcSnapshotImportRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	defer rpc.stream.Close()
+
+	if err := rpc.sendResponse(RpcEmptyResponse{}); err != nil {
+		return err
+	}
+
+	if err := rpc.handler.SnapshotImport(ctx, rpc.stream); err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	return rpc.sendResponse(RpcEmptyResponse{})
+}
+
+func (rpc *RpcServer) methodVolumeDelete(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcVolumeDeleteRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rpc.timeout)
+	defer cancel()
+
+	if err := rpc.handler.VolumeDelete(ctx, params.Name, params.Force); err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	return rpc.sendResponse(RpcEmptyResponse{})
+}
+
+func (rpc *RpcServer) methodPing(ctx context.Context, rawParams json.RawMessage) error {
+	var params RpcPingRequestParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rpc.timeout)
+	defer cancel()
+
+	if err := rpc.handler.Ping(ctx); err != nil {
+		return rpc.sendResponse(NewRpcError(err))
+	}
+
+	return rpc.sendResponse(RpcEmptyResponse{})
+}
+
 func (rpc *RpcServer) sendResponse(res any) error {
 	return json.NewEncoder(rpc.stream).Encode(res)
 }